@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cmu440/bitcoin"
+	"github.com/cmu440/lsp"
+	"os"
+	"strings"
+)
+
+func main() {
+	const minArgs = 3
+	if len(os.Args) < minArgs {
+		fmt.Println("Usage: ./admin <adminHostport> status | drain <minerId> | kick <minerId>")
+		return
+	}
+
+	hostport := os.Args[1]
+	params := lsp.NewParams()
+	lspClient, err := lsp.NewClient(hostport, params)
+	if err != nil {
+		fmt.Println("cannot craete client or connect to the server")
+		return
+	}
+	defer lspClient.Close()
+
+	// send the command to the server and print its reply
+	buf, err := json.Marshal(bitcoin.NewAdmin(strings.Join(os.Args[2:], " ")))
+	if err != nil {
+		fmt.Println("error when marshalling")
+		return
+	}
+	err = lspClient.Write(buf)
+	if err != nil {
+		fmt.Println("unable to write to server, connection lost")
+		return
+	}
+
+	// the reply comes one line per message, an admin done message ends it
+	for {
+		buf, err = lspClient.Read()
+		if err != nil {
+			fmt.Println("Disconnected")
+			return
+		}
+		replyMsg := &bitcoin.Message{}
+		err = json.Unmarshal(buf, replyMsg)
+		if err != nil {
+			fmt.Println("error when unmarshalling")
+			return
+		}
+		if replyMsg.Type == bitcoin.AdminDone {
+			return
+		}
+		fmt.Println(replyMsg.Data)
+	}
+}
@@ -2,63 +2,107 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/cmu440/bitcoin"
 	"github.com/cmu440/lsp"
-	"os"
 	"strconv"
+	"time"
 )
 
+// number of times a request with an ID is sent again after the connection to the server is lost
+const maxReconnects = 10
+
+var requestID = flag.Uint64("id", 0, "ID of the request, to resume it on the server after the connection is lost")
+
 func main() {
-	const numArgs = 4
-	if len(os.Args) != numArgs {
-		fmt.Println("Usage: ./client <hostport> <message> <maxNonce>")
+	const numArgs = 3
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != numArgs && len(args) != numArgs+1 {
+		fmt.Println("Usage: ./client [-id <requestId>] <hostport> <message> <maxNonce> [target]")
 		return
 	}
 
-	hostport := os.Args[1]
-	data := os.Args[2]
-	maxNonce, err := strconv.ParseUint(os.Args[3], 10, 64)
+	hostport := args[0]
+	data := args[1]
+	maxNonce, err := strconv.ParseUint(args[2], 10, 64)
 
 	if err != nil {
 		fmt.Println("error when parsing maxNonce")
 		return
 	}
 
-	params := lsp.NewParams()
-	lspClient, err := lsp.NewClient(hostport, params)
-	if err != nil {
-		fmt.Println("cannot craete client or connect to the server")
-		return
+	// with a target, the result is the lowest nonce with a hash below it
+	var target uint64
+	if len(args) == numArgs+1 {
+		target, err = strconv.ParseUint(args[3], 10, 64)
+		if err != nil || target == 0 {
+			fmt.Println("error when parsing target")
+			return
+		}
 	}
 
-	reqMsg := bitcoin.NewRequest(data, 0, maxNonce)
+	reqMsg := bitcoin.NewTargetRequest(data, 0, maxNonce, target)
+	reqMsg.ID = *requestID
 	buf, err := json.Marshal(reqMsg)
 	if err != nil {
 		fmt.Println("error when marshalling")
 		return
 	}
 
-	err = lspClient.Write(buf)
-	if err != nil {
-		fmt.Println("unable to write to server, connection lost")
-		return
+	// a request with an ID is journaled by the server, so it is sent again on a new connection
+	// when the connection is lost, and the server resumes it where it was interrupted
+	canRetry := func(attempt int) bool {
+		if *requestID == 0 || attempt >= maxReconnects {
+			return false
+		}
+		time.Sleep(time.Second)
+		fmt.Println("reconnecting to resume request", *requestID)
+		return true
 	}
+	params := lsp.NewParams()
+	for attempt := 0; ; attempt++ {
+		lspClient, err := lsp.NewClient(hostport, params)
+		if err != nil {
+			if canRetry(attempt) {
+				continue
+			}
+			fmt.Println("cannot craete client or connect to the server")
+			return
+		}
 
-	buf, err = lspClient.Read()
-	if err != nil {
-		printDisconnected()
-		return
-	}
+		// the old client is closed before a new one is dialed, so that its go routines and socket don't pile up
+		err = lspClient.Write(buf)
+		if err != nil {
+			lspClient.Close()
+			if canRetry(attempt) {
+				continue
+			}
+			fmt.Println("unable to write to server, connection lost")
+			return
+		}
 
-	resultMsg := &bitcoin.Message{}
-	err = json.Unmarshal(buf, resultMsg)
-	if err != nil {
-		fmt.Println("error when unmarshalling")
+		resultBuf, err := lspClient.Read()
+		if err != nil {
+			lspClient.Close()
+			if canRetry(attempt) {
+				continue
+			}
+			printDisconnected()
+			return
+		}
+
+		resultMsg := &bitcoin.Message{}
+		err = json.Unmarshal(resultBuf, resultMsg)
+		if err != nil {
+			fmt.Println("error when unmarshalling")
+			return
+		}
+
+		printResult(strconv.FormatUint(resultMsg.Hash, 10), strconv.FormatUint(resultMsg.Nonce, 10))
 		return
 	}
-
-	printResult(strconv.FormatUint(resultMsg.Hash, 10), strconv.FormatUint(resultMsg.Nonce, 10))
 }
 
 // printResult prints the final result to stdout.
@@ -3,13 +3,44 @@ package bitcoin
 import (
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
+	"hash"
+	"strconv"
 )
 
 // Hash concatentates a message and a nonce and generates a hash value.
 // Only miners should ever need to call this method.
 func Hash(msg string, nonce uint64) uint64 {
-	hasher := sha256.New()
-	hasher.Write([]byte(fmt.Sprintf("%s %d", msg, nonce)))
-	return binary.BigEndian.Uint64(hasher.Sum(nil))
+	return NewHasher(msg).Hash(nonce)
+}
+
+// Hasher generates the same hash values as Hash for one message, reusing the
+// SHA-256 state and buffers across nonces. A Hasher must not be used by more
+// than one goroutine at a time.
+type Hasher struct {
+	hasher hash.Hash
+	buf    []byte // the message and a space, followed by the current nonce
+	prefix int    // length of the message and the space in buf
+	sum    []byte
+}
+
+// NewHasher returns a Hasher for msg.
+func NewHasher(msg string) *Hasher {
+	buf := make([]byte, 0, len(msg)+1+20)
+	buf = append(buf, msg...)
+	buf = append(buf, ' ')
+	return &Hasher{
+		hasher: sha256.New(),
+		buf:    buf,
+		prefix: len(buf),
+		sum:    make([]byte, 0, sha256.Size),
+	}
+}
+
+// Hash concatenates the message of the Hasher and a nonce and generates a hash value.
+func (h *Hasher) Hash(nonce uint64) uint64 {
+	h.buf = strconv.AppendUint(h.buf[:h.prefix], nonce, 10)
+	h.hasher.Reset()
+	h.hasher.Write(h.buf)
+	h.sum = h.hasher.Sum(h.sum[:0])
+	return binary.BigEndian.Uint64(h.sum)
 }
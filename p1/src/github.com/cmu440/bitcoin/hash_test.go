@@ -0,0 +1,56 @@
+package bitcoin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// the hash of a message and a nonce as first defined, formatting them with fmt
+func referenceHash(msg string, nonce uint64) uint64 {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d", msg, nonce)))
+	return binary.BigEndian.Uint64(sum[:])
+}
+
+func TestHasher(t *testing.T) {
+	for _, test := range []struct {
+		msg    string
+		nonces []uint64
+	}{
+		{"hello", []uint64{0, 1, 9, 10, 2310407, 99, 100000}},
+		{"", []uint64{0, 42}},
+		{"with spaces and ünïcode", []uint64{7, 123456789}},
+		// nonces of decreasing length reuse the buffer of longer ones
+		{"dup", []uint64{math.MaxUint64, 1 << 40, 7, 0}},
+	} {
+		hasher := NewHasher(test.msg)
+		for _, nonce := range test.nonces {
+			expected := referenceHash(test.msg, nonce)
+			if got := hasher.Hash(nonce); got != expected {
+				t.Errorf("Hasher(%q).Hash(%d) = %d, expected %d", test.msg, nonce, got, expected)
+			}
+			if got := Hash(test.msg, nonce); got != expected {
+				t.Errorf("Hash(%q, %d) = %d, expected %d", test.msg, nonce, got, expected)
+			}
+		}
+	}
+}
+
+func TestHasherKnownResults(t *testing.T) {
+	for _, test := range []struct {
+		msg   string
+		nonce uint64
+		hash  uint64
+	}{
+		{"hello", 2310407, 3246444900823},
+		{"hello", 5557654, 2316599716883},
+		{"world", 56148, 21355299366990},
+		{"dup", 7, 730498943777382008},
+	} {
+		if got := NewHasher(test.msg).Hash(test.nonce); got != test.hash {
+			t.Errorf("Hasher(%q).Hash(%d) = %d, expected %d", test.msg, test.nonce, got, test.hash)
+		}
+	}
+}
@@ -8,16 +8,25 @@ const (
 	Join MsgType = iota
 	Request
 	Result
+	Truncate
+	Cancel
+	Progress
+	Admin
+	AdminDone
 )
 
 // Message represents a message that can be sent between components in the bitcoin
 // mining distributed system. Messages must be marshalled into a byte slice before being
-// sent over the network.
+// sent over the network. Result and progress messages carry the range of nonces
+// they cover in Lower and Upper.
 type Message struct {
 	Type         MsgType
 	Data         string
 	Lower, Upper uint64
 	Hash, Nonce  uint64
+	Target       uint64 // if not 0, a request is done at the first nonce with a hash below Target
+	HashRate     uint64 // hashes per second of a miner, in its join message
+	ID           uint64 // identifies a request among those of a client, and across reconnects and server restarts if not 0
 }
 
 // NewRequest creates a request message. Clients send request messages to the
@@ -31,8 +40,19 @@ func NewRequest(data string, lower, upper uint64) *Message {
 	}
 }
 
+// NewTargetRequest creates a request message in difficulty-target mode. Instead of
+// the minimum hash of the whole range, the result is the lowest nonce whose hash is
+// below target, or the minimum hash of the range if there is none.
+func NewTargetRequest(data string, lower, upper, target uint64) *Message {
+	msg := NewRequest(data, lower, upper)
+	msg.Target = target
+	return msg
+}
+
 // New result creates a result message. Miners send result messages to the server
-// and the server sends result messages to clients.
+// and the server sends result messages to clients. A client can send several
+// requests with different IDs without waiting for their results, the result of
+// each request carries its ID and results may come in any order.
 func NewResult(hash, nonce uint64) *Message {
 	return &Message{
 		Type:  Result,
@@ -41,6 +61,65 @@ func NewResult(hash, nonce uint64) *Message {
 	}
 }
 
+// NewTruncate creates a truncate message. The server sends truncate messages to a
+// busy miner to take the nonces above upper of its current request, identified by
+// data and lower, away from it so that another miner can work on them.
+func NewTruncate(data string, lower, upper uint64) *Message {
+	return &Message{
+		Type:  Truncate,
+		Data:  data,
+		Lower: lower,
+		Upper: upper,
+	}
+}
+
+// NewCancel creates a cancel message. The server sends cancel messages to a busy
+// miner whose current request, identified by data and lower, is no longer needed.
+// The miner stops at the end of its current batch and reports the result of the
+// nonces it hashed so far. A client cancels one of its requests with a cancel
+// message carrying the ID of the request, no result is sent back for it.
+func NewCancel(data string, lower uint64) *Message {
+	return &Message{
+		Type:  Cancel,
+		Data:  data,
+		Lower: lower,
+	}
+}
+
+// NewProgress creates a progress message. Miners send progress messages to the
+// server while working on a request, identified by data and lower, with the
+// nonces from lower to upper hashed so far and the minimum hash among them. They
+// are sent unreliably, each one covering all the nonces of the ones before.
+func NewProgress(data string, lower, upper, hash, nonce uint64) *Message {
+	return &Message{
+		Type:  Progress,
+		Data:  data,
+		Lower: lower,
+		Upper: upper,
+		Hash:  hash,
+		Nonce: nonce,
+	}
+}
+
+// NewAdmin creates an admin message. Admin clients send admin messages with a
+// command to the admin port of the server, which only listens on the loopback
+// address. The server replies with one admin message per line of the outcome,
+// followed by an admin done message. See the admin command for the commands the
+// server understands.
+func NewAdmin(text string) *Message {
+	return &Message{
+		Type: Admin,
+		Data: text,
+	}
+}
+
+// NewAdminDone creates an admin done message, which ends the reply of the server
+// to an admin command. Lines of the reply may be empty, so the end of the reply
+// has a type of its own.
+func NewAdminDone() *Message {
+	return &Message{Type: AdminDone}
+}
+
 // NewJoin creates a join message. Miners send join messages to the server.
 func NewJoin() *Message {
 	return &Message{Type: Join}
@@ -50,11 +129,25 @@ func (m *Message) String() string {
 	var result string
 	switch m.Type {
 	case Request:
-		result = fmt.Sprintf("[%s %s %d %d]", "Request", m.Data, m.Lower, m.Upper)
+		if m.Target != 0 {
+			result = fmt.Sprintf("[%s %s %d %d target %d]", "Request", m.Data, m.Lower, m.Upper, m.Target)
+		} else {
+			result = fmt.Sprintf("[%s %s %d %d]", "Request", m.Data, m.Lower, m.Upper)
+		}
 	case Result:
 		result = fmt.Sprintf("[%s %d %d]", "Result", m.Hash, m.Nonce)
 	case Join:
 		result = fmt.Sprintf("[%s]", "Join")
+	case Truncate:
+		result = fmt.Sprintf("[%s %s %d %d]", "Truncate", m.Data, m.Lower, m.Upper)
+	case Cancel:
+		result = fmt.Sprintf("[%s %s %d]", "Cancel", m.Data, m.Lower)
+	case Admin:
+		result = fmt.Sprintf("[%s %q]", "Admin", m.Data)
+	case AdminDone:
+		result = fmt.Sprintf("[%s]", "AdminDone")
+	case Progress:
+		result = fmt.Sprintf("[%s %s %d %d %d %d]", "Progress", m.Data, m.Lower, m.Upper, m.Hash, m.Nonce)
 	}
 	return result
 }
@@ -7,9 +7,27 @@ import (
 	"github.com/cmu440/lsp"
 	"math"
 	"os"
+	"runtime"
+	"sync"
+	"time"
 )
 
-var lspClient lsp.Client
+// number of nonces hashed by each worker between two checks for messages from the server
+const batchSize = 1000
+
+// time between two progress messages to the server while calculating a request
+const progressInterval = 250 * time.Millisecond
+
+// number of goroutines hashing in parallel, one per CPU
+var numWorkers = runtime.GOMAXPROCS(0)
+
+var (
+	lspClient lsp.Client
+	// messages read from the server, closed when the connection is lost
+	msgc chan *bitcoin.Message
+	// messages received while calculating, to be handled after the current request
+	pending []*bitcoin.Message
+)
 
 // marshall and send message to the server
 func sendMessage(msg *bitcoin.Message) error {
@@ -25,19 +43,193 @@ func sendMessage(msg *bitcoin.Message) error {
 	return nil
 }
 
-// calculate the minimum hash number and corresponding nonce in the given range
-func calculateMinHash(data string, lower, upper uint64) (minHash, nonce uint64) {
+// send a progress message to the server. it is not retransmitted if lost, the next one covers its nonces
+func sendProgress(msg *bitcoin.Message) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return lspClient.WriteUnreliable(buf)
+}
+
+// read messages from the server into msgc, so that they can be checked between batches
+func readMessages() {
+	for {
+		buf, err := lspClient.Read()
+		if err != nil {
+			close(msgc)
+			return
+		}
+		msg := &bitcoin.Message{}
+		err = json.Unmarshal(buf, msg)
+		if err != nil {
+			fmt.Println("error when unmarshalling message")
+			continue
+		}
+		msgc <- msg
+	}
+}
+
+// handle the messages received so far while calculating the given request. a truncate
+// message for the request lowers its upper bound and a cancel message ends it at the
+// current batch, other messages are kept for later. return false if the connection is lost
+func checkMessages(data string, lower uint64, upper *uint64) bool {
+	for {
+		select {
+		case msg, ok := <-msgc:
+			if !ok {
+				return false
+			}
+			if msg.Type == bitcoin.Truncate && msg.Data == data && msg.Lower == lower {
+				if msg.Upper < *upper {
+					*upper = msg.Upper
+				}
+			} else if msg.Type == bitcoin.Cancel && msg.Data == data && msg.Lower == lower {
+				fmt.Println("cancelled... ", data, lower)
+				*upper = lower
+			} else {
+				pending = append(pending, msg)
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// result of hashing a range of nonces
+type rangeResult struct {
+	minHash, nonce uint64
+	found          bool // a hash below the target was found, at nonce
+}
+
+// hash the nonces from lower to upper. if target is not 0, stop at the first nonce with a hash below target
+func hashRange(hasher *bitcoin.Hasher, lower, upper, target uint64) rangeResult {
+	res := rangeResult{minHash: math.MaxUint64}
+	for i := lower; ; i++ {
+		hash := hasher.Hash(i)
+		if hash < res.minHash {
+			res.minHash = hash
+			res.nonce = i
+		}
+		if hash < target {
+			res.found = true
+			return res
+		}
+		if i >= upper {
+			return res
+		}
+	}
+}
+
+// hash the nonces from lower to upper, split into one contiguous part per worker. the result
+// has the minimum hash, or the first nonce with a hash below target if target is not 0 and
+// there is one
+func hashParallel(hashers []*bitcoin.Hasher, lower, upper, target uint64) rangeResult {
+	results := make([]rangeResult, len(hashers))
+	size := (upper-lower)/uint64(len(hashers)) + 1
+	var wg sync.WaitGroup
+	for i := range hashers {
+		results[i] = rangeResult{minHash: math.MaxUint64}
+		partLower := lower + uint64(i)*size
+		if partLower > upper || partLower < lower {
+			continue
+		}
+		partUpper := upper
+		if upper-partLower >= size {
+			partUpper = partLower + size - 1
+		}
+		wg.Add(1)
+		go func(i int, partLower, partUpper uint64) {
+			defer wg.Done()
+			results[i] = hashRange(hashers[i], partLower, partUpper, target)
+		}(i, partLower, partUpper)
+	}
+	wg.Wait()
+
+	// the parts are in nonce order, so the first part which found a hash below the target has the first nonce
+	res := rangeResult{minHash: math.MaxUint64}
+	for _, partRes := range results {
+		if partRes.found {
+			return partRes
+		}
+		if partRes.minHash < res.minHash {
+			res = partRes
+		}
+	}
+	return res
+}
+
+// create one hasher of data per worker
+func newHashers(data string) []*bitcoin.Hasher {
+	hashers := make([]*bitcoin.Hasher, numWorkers)
+	for i := range hashers {
+		hashers[i] = bitcoin.NewHasher(data)
+	}
+	return hashers
+}
+
+// calculate the minimum hash number and corresponding nonce in the given range, in rounds of batchSize
+// nonces per worker. if target is not 0, stop at the first nonce with a hash below target. the range
+// may be truncated or cancelled by the server between rounds, covered is the upper end of the nonces
+// actually hashed. the nonces hashed so far are reported to the server every progressInterval.
+// ok is false if the connection is lost
+func calculateMinHash(data string, lower, upper, target uint64) (minHash, nonce, covered uint64, ok bool) {
+	hashers := newHashers(data)
+	roundSize := batchSize * uint64(numWorkers)
 	minHash = math.MaxUint64
 	nonce = 0
-	for i := lower; i <= upper; i++ {
-		hash := bitcoin.Hash(data, i)
-		if hash < minHash {
-			minHash = hash
-			nonce = i
+	lastProgress := time.Now()
+	for pos := lower; ; {
+		end := upper
+		if upper-pos >= roundSize {
+			end = pos + roundSize - 1
+		}
+		res := hashParallel(hashers, pos, end, target)
+		covered = end
+		if res.minHash < minHash {
+			minHash = res.minHash
+			nonce = res.nonce
+		}
+		if res.found {
+			return res.minHash, res.nonce, covered, true
+		}
+		if !checkMessages(data, lower, &upper) {
+			return minHash, nonce, covered, false
 		}
+		if end >= upper {
+			return minHash, nonce, covered, true
+		}
+		if time.Since(lastProgress) >= progressInterval {
+			sendProgress(bitcoin.NewProgress(data, lower, covered, minHash, nonce))
+			lastProgress = time.Now()
+		}
+		pos = end + 1
+	}
+}
+
+// measure the number of hashes per second the workers of this miner calculate
+func measureHashRate() uint64 {
+	const duration = 200 * time.Millisecond
+	hashers := newHashers("benchmark")
+	roundSize := batchSize * uint64(numWorkers)
+	start := time.Now()
+	var hashed uint64
+	for time.Since(start) < duration {
+		hashParallel(hashers, hashed, hashed+roundSize-1, 0)
+		hashed += roundSize
+	}
+	return uint64(float64(hashed) / time.Since(start).Seconds())
+}
+
+// return the next message from the server, false if the connection is lost
+func nextMessage() (*bitcoin.Message, bool) {
+	if len(pending) > 0 {
+		msg := pending[0]
+		pending = pending[1:]
+		return msg, true
 	}
-	fmt.Println(minHash, nonce)
-	return
+	msg, ok := <-msgc
+	return msg, ok
 }
 
 func main() {
@@ -58,32 +250,38 @@ func main() {
 		return
 	}
 
-	// send Join message to the server
+	// send Join message to the server, with the hash rate of this miner
 	joinMsg := bitcoin.NewJoin()
+	joinMsg.HashRate = measureHashRate()
+	fmt.Println("hash rate: ", joinMsg.HashRate, " with workers: ", numWorkers)
 	err = sendMessage(joinMsg)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	msgc = make(chan *bitcoin.Message)
+	go readMessages()
 	for {
-		buf, err := lspClient.Read()
-		if err != nil {
+		reqMsg, ok := nextMessage()
+		if !ok {
 			fmt.Println("connection lost when reading from server")
 			return
 		}
-
-		reqMsg := &bitcoin.Message{}
-		err = json.Unmarshal(buf, reqMsg)
-		if err != nil {
-			fmt.Println("error when unmarshalling message")
-			return
+		// a truncate or cancel message for a request which is already done is stale
+		if reqMsg.Type != bitcoin.Request {
+			continue
 		}
 
 		// calculate the minhash and nonce and send the result back to server
 		fmt.Println("calculating... ", reqMsg.Data, reqMsg.Lower, reqMsg.Upper)
-		hash, nonce := calculateMinHash(reqMsg.Data, reqMsg.Lower, reqMsg.Upper)
+		hash, nonce, covered, ok := calculateMinHash(reqMsg.Data, reqMsg.Lower, reqMsg.Upper, reqMsg.Target)
+		if !ok {
+			fmt.Println("connection lost when calculating")
+			return
+		}
 		resultMsg := bitcoin.NewResult(hash, nonce)
+		resultMsg.Lower, resultMsg.Upper = reqMsg.Lower, covered
 		fmt.Println("sending back result: ", hash, nonce)
 		sendMessage(resultMsg)
 	}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/cmu440/bitcoin"
+)
+
+func TestCheckMessages(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		msgs    []*bitcoin.Message // received from the server while hashing "hello" from 100 to 999
+		closed  bool               // connection lost after msgs
+		upper   uint64
+		pending int
+	}{
+		{"nothing", nil, false, 999, 0},
+		{"cancel", []*bitcoin.Message{bitcoin.NewCancel("hello", 100)}, false, 100, 0},
+		{"cancel of other data", []*bitcoin.Message{bitcoin.NewCancel("world", 100)}, false, 999, 1},
+		{"cancel of other lower", []*bitcoin.Message{bitcoin.NewCancel("hello", 0)}, false, 999, 1},
+		{"truncate", []*bitcoin.Message{bitcoin.NewTruncate("hello", 100, 499)}, false, 499, 0},
+		{"truncate above upper", []*bitcoin.Message{bitcoin.NewTruncate("hello", 100, 1999)}, false, 999, 0},
+		{"truncate then cancel", []*bitcoin.Message{bitcoin.NewTruncate("hello", 100, 499),
+			bitcoin.NewCancel("hello", 100)}, false, 100, 0},
+		{"next request", []*bitcoin.Message{bitcoin.NewRequest("world", 0, 99)}, false, 999, 1},
+		{"connection lost", []*bitcoin.Message{bitcoin.NewCancel("world", 100)}, true, 999, 1},
+	} {
+		msgc = make(chan *bitcoin.Message, len(test.msgs))
+		pending = nil
+		for _, msg := range test.msgs {
+			msgc <- msg
+		}
+		if test.closed {
+			close(msgc)
+		}
+		upper := uint64(999)
+		if ok := checkMessages("hello", 100, &upper); ok == test.closed {
+			t.Errorf("%s: returned %v with the connection lost %v", test.name, ok, test.closed)
+		}
+		if upper != test.upper || len(pending) != test.pending {
+			t.Errorf("%s: upper %d with %d pending messages, expected %d with %d",
+				test.name, upper, len(pending), test.upper, test.pending)
+		}
+	}
+}
+
+func TestHashParallelTarget(t *testing.T) {
+	// about one nonce in 50 has a hash below the target, so most parts of the range have one
+	target := uint64(math.MaxUint64 / 50)
+	for i := 0; i < 50; i++ {
+		data := fmt.Sprintf("data %d", i)
+		hashers := make([]*bitcoin.Hasher, 4)
+		for j := range hashers {
+			hashers[j] = bitcoin.NewHasher(data)
+		}
+		// the first nonce below the target, or the minimum hash if there is none
+		expected := rangeResult{minHash: math.MaxUint64}
+		for nonce := uint64(0); nonce <= 999; nonce++ {
+			if hash := bitcoin.Hash(data, nonce); hash < target {
+				expected = rangeResult{hash, nonce, true}
+				break
+			} else if hash < expected.minHash {
+				expected = rangeResult{minHash: hash, nonce: nonce}
+			}
+		}
+		if res := hashParallel(hashers, 0, 999, target); res != expected {
+			t.Errorf("%q: hashed %+v, expected %+v", data, res, expected)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cmu440/bitcoin"
+	"github.com/cmu440/lsp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// miners which finish their current work unit but get no new one
+	drained map[int]bool
+	// admin clients connect to a separate server listening on the loopback address only, so that
+	// clients and miners can't drain or kick miners
+	adminServer lsp.Server
+)
+
+// return the number of miners which get work units, i.e. are not drained
+func activeMiners() int {
+	return len(minerCurrWork) - len(drained)
+}
+
+// marshall and send a message to an admin client
+func sendAdminMessage(connId int, msg *bitcoin.Message) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return adminServer.Write(connId, buf)
+}
+
+// handle income message from an admin client
+func handleAdminMessage(connId int, payLoad []byte) {
+	msg := &bitcoin.Message{}
+	err := json.Unmarshal(payLoad, msg)
+	if err != nil || msg.Type != bitcoin.Admin {
+		fmt.Println("cannot unmarshall the admin message")
+		return
+	}
+	handleAdmin(connId, msg)
+}
+
+// handle a command of an admin client and send the reply back to it, one admin message per line
+// so that a long status fits in LSP messages however many miners and clients there are, followed
+// by an admin done message which ends the reply. the commands are:
+//
+//	status         list the miners, client requests and queues
+//	drain <miner>  stop handing out work units to a miner once it finishes its current one
+//	kick <miner>   close the connection of a miner, its work goes back to the job queue
+func handleAdmin(connId int, msg *bitcoin.Message) {
+	var reply string
+	fields := strings.Fields(msg.Data)
+	switch {
+	case len(fields) == 1 && fields[0] == "status":
+		reply = statusReport()
+	case len(fields) == 2 && (fields[0] == "drain" || fields[0] == "kick"):
+		minerId, err := strconv.Atoi(fields[1])
+		if _, ok := minerCurrWork[minerId]; err != nil || !ok {
+			reply = fmt.Sprintf("no miner %s", fields[1])
+		} else if fields[0] == "drain" {
+			drained[minerId] = true
+			reply = fmt.Sprintf("miner %d drained", minerId)
+		} else {
+			handleFailure(minerId)
+			lspServer.CloseConn(minerId)
+			reply = fmt.Sprintf("miner %d kicked", minerId)
+		}
+	default:
+		reply = fmt.Sprintf("unknown command %q", msg.Data)
+	}
+	FLOG.Printf("admin command %q: %s\n", msg.Data, reply)
+	for _, line := range strings.Split(reply, "\n") {
+		sendAdminMessage(connId, bitcoin.NewAdmin(line))
+	}
+	sendAdminMessage(connId, bitcoin.NewAdminDone())
+}
+
+// describe the miners with their current work unit and hash rate, the client requests with
+// their progress and the length of the queues
+func statusReport() string {
+	var b strings.Builder
+	minerIds := make([]int, 0, len(minerCurrWork))
+	for minerId := range minerCurrWork {
+		minerIds = append(minerIds, minerId)
+	}
+	sort.Ints(minerIds)
+	fmt.Fprintf(&b, "%d miners\n", len(minerIds))
+	for _, minerId := range minerIds {
+		fmt.Fprintf(&b, "  miner %d: %.0f hashes/s", minerId, minerHashRate[minerId])
+		if drained[minerId] {
+			b.WriteString(", drained")
+		}
+		if workU := minerCurrWork[minerId]; workU == nil {
+			b.WriteString(", idle")
+		} else {
+			fmt.Fprintf(&b, ", working on %s nonces %d to %d for %v, %d hashed",
+				workU.workMsg.Data, workU.workMsg.Lower, workU.workMsg.Upper, workU.clientWorkFor, workU.hashed)
+			if workU.check != nil {
+				fmt.Fprintf(&b, " (spot check of miner %d)", workU.check.minerId)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	keys := sortedRequestKeys()
+	fmt.Fprintf(&b, "%d client requests\n", len(keys))
+	for _, key := range keys {
+		status := clients[key]
+		queued := uint64(0)
+		if !status.allAssigned {
+			queued = status.upper - status.nextLower + 1
+		}
+		fmt.Fprintf(&b, "  %v: %s nonces %d to %d, %d queued, %d work units in progress, min hash %d\n",
+			key, status.data, status.lower, status.upper, queued, status.notFinishedJob, status.minHash)
+	}
+	fmt.Fprintf(&b, "%d work units and spot checks in the job queue, %d clients in the client queue",
+		jobQ.Len(), clientQ.Len())
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cmu440/bitcoin"
+)
+
+// connection of the admin client to the fake admin server
+const adminConn = 100
+
+// use a fake admin server, which records the replies to admin commands
+func useAdminServer() *fakeServer {
+	admin := &fakeServer{written: make(map[int][]*bitcoin.Message), closed: make(map[int]bool)}
+	adminServer = admin
+	return admin
+}
+
+// send an admin command to the server and return the lines of its reply, which must end with an
+// admin done message
+func adminCommand(t *testing.T, admin *fakeServer, command string) []string {
+	admin.written[adminConn] = nil
+	buf, _ := json.Marshal(bitcoin.NewAdmin(command))
+	handleAdminMessage(adminConn, buf)
+	msgs := admin.written[adminConn]
+	if len(msgs) == 0 || msgs[len(msgs)-1].Type != bitcoin.AdminDone {
+		t.Fatalf("Reply to %q is %v, expected lines ending with an admin done message", command, msgs)
+	}
+	var lines []string
+	for _, msg := range msgs[:len(msgs)-1] {
+		if msg.Type != bitcoin.Admin {
+			t.Fatalf("Reply to %q has %v, expected admin messages", command, msg)
+		}
+		lines = append(lines, msg.Data)
+	}
+	return lines
+}
+
+func TestAdminDrain(t *testing.T) {
+	srv := resetState(t)
+	admin := useAdminServer()
+	addMiner(1, 0)
+	addMiner(2, 0)
+	key := requestKey{3, 0}
+	scheduleRequest(key, bitcoin.NewRequest("hello", 0, 100*MinerWorkloadThreshold))
+	workU := startWork(t, 1)
+
+	if reply := adminCommand(t, admin, "drain 1"); len(reply) != 1 || reply[0] != "miner 1 drained" {
+		t.Fatalf("Reply to drain is %q", reply)
+	}
+	if reply := adminCommand(t, admin, "drain 5"); len(reply) != 1 || reply[0] != "no miner 5" {
+		t.Fatalf("Reply to drain of an unknown miner is %q", reply)
+	}
+	// the drained miner finishes its current work unit, which counts for the request
+	lower := workU.workMsg.Lower
+	receive(1, resultOf("hello", lower, workU.workMsg.Upper, lower))
+	if status := clients[key]; status.minHash != bitcoin.Hash("hello", lower) || status.notFinishedJob != 0 {
+		t.Fatalf("Work unit of the drained miner not counted for the request")
+	}
+	// but gets no new one, unlike the other miner
+	assignJobsToUnoccupiedMiner()
+	if minerCurrWork[1] != nil || len(srv.written[1]) != 0 {
+		t.Fatalf("Drained miner 1 got %s", describe(minerCurrWork[1]))
+	}
+	if minerCurrWork[2] == nil || len(srv.written[2]) != 1 {
+		t.Fatalf("Miner 2 got no work unit")
+	}
+	if srv.closed[1] {
+		t.Fatalf("Drained miner 1 disconnected")
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	srv := resetState(t)
+	admin := useAdminServer()
+	addMiner(1, 0)
+	key := requestKey{3, 0}
+	scheduleRequest(key, bitcoin.NewRequest("hello", 0, 100*MinerWorkloadThreshold))
+	assignWork(1, key, 0, 9999, 0)
+	updateProgress(1, progressOf("hello", 0, 4999, 42))
+
+	if reply := adminCommand(t, admin, "kick 1"); len(reply) != 1 || reply[0] != "miner 1 kicked" {
+		t.Fatalf("Reply to kick is %q", reply)
+	}
+	if !srv.closed[1] {
+		t.Fatalf("Connection of kicked miner 1 not closed")
+	}
+	if _, ok := minerCurrWork[1]; ok || unOccupiedMiner[1] {
+		t.Fatalf("Kicked miner 1 still gets work units")
+	}
+	// the nonces the miner did not report hashed go back to the job queue
+	if jobQ.Len() != 1 || jobQ.Front().Value.(*workUnit).workMsg.Lower != 5000 ||
+		jobQ.Front().Value.(*workUnit).workMsg.Upper != 9999 {
+		t.Fatalf("Job queue has %d work units, expected the nonces 5000 to 9999 of miner 1", jobQ.Len())
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	resetState(t)
+	admin := useAdminServer()
+	addMiner(1, 2500)
+	addMiner(2, 0)
+	drained[2] = true
+	key := requestKey{3, 7}
+	msg := bitcoin.NewRequest("hello", 0, 99999)
+	msg.ID = 7
+	scheduleRequest(key, msg)
+	startWork(t, 1)
+	jobQ.PushBack(&workUnit{clientWorkFor: key, workMsg: bitcoin.NewRequest("hello", 50, 60)})
+
+	reply := adminCommand(t, admin, "status")
+	expected := []string{
+		"2 miners",
+		"  miner 1: 2500 hashes/s, working on hello nonces 0 to 9999 for client 3 request 7, 0 hashed",
+		"  miner 2: 0 hashes/s, drained, idle",
+		"1 client requests",
+		"  client 3 request 7: hello nonces 0 to 99999, 90000 queued, 1 work units in progress, min hash 18446744073709551615",
+		"1 work units and spot checks in the job queue, 1 clients in the client queue",
+	}
+	if strings.Join(reply, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Status is\n%s\nexpected\n%s", strings.Join(reply, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if reply := adminCommand(t, admin, ""); len(reply) != 1 || reply[0] != `unknown command ""` {
+		t.Fatalf("Reply to an empty command is %q", reply)
+	}
+}
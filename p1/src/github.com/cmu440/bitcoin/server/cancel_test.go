@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+// hand the next work unit out to a miner, as assignJobsToUnoccupiedMiner does
+func startWork(t *testing.T, minerId int) *workUnit {
+	workU := nextWorkUnit(minerId)
+	if workU == nil {
+		t.Fatalf("No work unit for miner %d", minerId)
+	}
+	workU.assignedAt = time.Now()
+	minerCurrWork[minerId] = workU
+	delete(unOccupiedMiner, minerId)
+	return workU
+}
+
+// pass a message from a client or miner to the server
+func receive(connId int, msg *bitcoin.Message) {
+	buf, _ := json.Marshal(msg)
+	handleIncomeMessage(connId, buf)
+}
+
+// check that a request is gone from the queues, and that every miner working for it, and only those, got
+// a cancel message for its work unit
+func checkDropped(t *testing.T, srv *fakeServer, key requestKey, cancelled ...*workUnit) {
+	if clients[key] != nil {
+		t.Fatalf("%v still scheduled", key)
+	}
+	for e := jobQ.Front(); e != nil; e = e.Next() {
+		if workU := e.Value.(*workUnit); workU.clientWorkFor == key {
+			t.Fatalf("Work unit %s of %v left in the job queue", describe(workU), key)
+		}
+	}
+	if requests := requestQ[key.connId]; requests != nil {
+		for e := requests.Front(); e != nil; e = e.Next() {
+			if e.Value.(requestKey) == key {
+				t.Fatalf("%v left in the request queue of its client", key)
+			}
+		}
+	}
+	numCancels := 0
+	for minerId, msgs := range srv.written {
+		for _, msg := range msgs {
+			if msg.Type != bitcoin.Cancel {
+				continue
+			}
+			numCancels += 1
+			workU := minerCurrWork[minerId]
+			if workU == nil || workU.clientWorkFor != key || msg.Data != workU.workMsg.Data || msg.Lower != workU.workMsg.Lower {
+				t.Fatalf("Miner %d got %v while working on %s", minerId, msg, describe(workU))
+			}
+		}
+	}
+	if numCancels != len(cancelled) {
+		t.Fatalf("%d cancel messages sent, expected %d", numCancels, len(cancelled))
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	srv := resetState(t)
+	for minerId := 1; minerId <= 3; minerId++ {
+		addMiner(minerId, 0)
+	}
+	large := uint64(100 * MinerWorkloadThreshold)
+	cancelled, kept := requestKey{4, 1}, requestKey{4, 2}
+	receive(4, &bitcoin.Message{Type: bitcoin.Request, ID: 1, Data: "hello", Upper: large})
+	receive(4, &bitcoin.Message{Type: bitcoin.Request, ID: 2, Data: "world", Upper: large})
+	first, second, third := startWork(t, 1), startWork(t, 2), startWork(t, 3)
+	if first.clientWorkFor != cancelled || second.clientWorkFor != kept || third.clientWorkFor != cancelled {
+		t.Fatalf("Miners work for %v, %v and %v", first.clientWorkFor, second.clientWorkFor, third.clientWorkFor)
+	}
+	// a work unit of a lost miner waits in the job queue
+	jobQ.PushBack(&workUnit{clientWorkFor: cancelled, workMsg: bitcoin.NewRequest("hello", 50, 60)})
+
+	// cancel messages of another client, a miner or for another ID are ignored
+	receive(5, &bitcoin.Message{Type: bitcoin.Cancel, ID: 1})
+	receive(1, &bitcoin.Message{Type: bitcoin.Cancel, ID: 1})
+	receive(4, &bitcoin.Message{Type: bitcoin.Cancel, ID: 3})
+	if clients[cancelled] == nil || jobQ.Len() != 1 || len(srv.written) != 0 {
+		t.Fatalf("Request cancelled by a cancel message for another one")
+	}
+
+	receive(4, &bitcoin.Message{Type: bitcoin.Cancel, ID: 1})
+	checkDropped(t, srv, cancelled, first, third)
+	if clientQ.Len() != 1 || requestQ[4].Len() != 1 {
+		t.Fatalf("%d clients and %d of their requests queued, expected the other request only",
+			clientQ.Len(), requestQ[4].Len())
+	}
+	if len(srv.written[4]) != 0 {
+		t.Fatalf("Client got %v for its cancelled request", srv.written[4])
+	}
+	// the partial results of the cancelled work units are ignored, the other request goes on
+	receive(1, resultOf("hello", first.workMsg.Lower, first.workMsg.Lower+10, first.workMsg.Lower))
+	if minerCurrWork[1] != nil || blacklisted[1] {
+		t.Fatalf("Miner 1 not free after reporting its cancelled work unit")
+	}
+	if workU := startWork(t, 1); workU.clientWorkFor != kept {
+		t.Fatalf("Miner 1 got %s for %v, expected a work unit of %v", describe(workU), workU.clientWorkFor, kept)
+	}
+
+	// cancelling the last request of the client takes the client out of the queue
+	receive(4, &bitcoin.Message{Type: bitcoin.Cancel, ID: 2})
+	if clientQ.Len() != 0 || len(requestQ) != 0 {
+		t.Fatalf("%d clients queued, expected none", clientQ.Len())
+	}
+}
+
+func TestClientCancelJournaled(t *testing.T) {
+	resetState(t)
+	msg := bitcoin.NewRequest("hello", 0, 99999)
+	msg.ID = 7
+	receive(4, msg)
+	journaled := clients[requestKey{4, 7}].journaled
+	receive(4, &bitcoin.Message{Type: bitcoin.Cancel, ID: 7})
+	// the client gave the request up, it is not resumed by a later request with its ID
+	if requestJournal.requests[journaled] != nil {
+		t.Fatalf("Cancelled request %v left in the journal", journaled)
+	}
+}
+
+func TestClientLost(t *testing.T) {
+	srv := resetState(t)
+	for minerId := 1; minerId <= 3; minerId++ {
+		addMiner(minerId, 0)
+	}
+	large := uint64(100 * MinerWorkloadThreshold)
+	lost, other := requestKey{4, 0}, requestKey{5, 0}
+	receive(4, bitcoin.NewRequest("hello", 0, large))
+	receive(5, bitcoin.NewRequest("world", 0, large))
+	first, second, third := startWork(t, 1), startWork(t, 2), startWork(t, 3)
+	jobQ.PushBack(&workUnit{clientWorkFor: lost, workMsg: bitcoin.NewRequest("hello", 50, 60)})
+
+	handleFailure(4)
+	checkDropped(t, srv, lost, first, third)
+	if second.clientWorkFor != other || clientQ.Len() != 1 || clientQ.Front().Value.(int) != other.connId {
+		t.Fatalf("Client %d not the only one left in the queue", other.connId)
+	}
+	if requestQ[lost.connId] != nil {
+		t.Fatalf("Requests of the lost client left in the request queue")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+func TestFairShare(t *testing.T) {
+	large := uint64(100 * MinerWorkloadThreshold)
+	for _, test := range []struct {
+		name     string
+		requests []requestKey // in the order they arrive
+		upper    []uint64     // upper end of the range of each request
+		lost     []requestKey // requests of clients lost before any work unit is handed out
+		order    []requestKey // requests of the work units handed out
+		done     bool         // every nonce is handed out after those work units
+	}{
+		{
+			"one request each",
+			[]requestKey{{1, 0}, {2, 0}, {3, 0}},
+			[]uint64{large, large, large},
+			nil,
+			[]requestKey{{1, 0}, {2, 0}, {3, 0}, {1, 0}, {2, 0}, {3, 0}},
+			false,
+		},
+		{
+			// a client pipelining requests gets no more work units than a client with one request
+			"pipelined",
+			[]requestKey{{1, 1}, {1, 2}, {1, 3}, {2, 1}},
+			[]uint64{large, large, large, large},
+			nil,
+			[]requestKey{{1, 1}, {2, 1}, {1, 2}, {2, 1}, {1, 3}, {2, 1}, {1, 1}, {2, 1}},
+			false,
+		},
+		{
+			// a request with all its nonces handed out makes room for the next one of its client
+			"small request",
+			[]requestKey{{1, 1}, {1, 2}, {2, 1}},
+			[]uint64{10, large, large},
+			nil,
+			[]requestKey{{1, 1}, {2, 1}, {1, 2}, {2, 1}, {1, 2}, {2, 1}},
+			false,
+		},
+		{
+			"one client left",
+			[]requestKey{{1, 1}, {2, 1}, {2, 2}},
+			[]uint64{10, large, large},
+			[]requestKey{{2, 1}, {2, 2}},
+			[]requestKey{{1, 1}},
+			true,
+		},
+		{
+			"lost client",
+			[]requestKey{{1, 0}, {2, 0}, {3, 0}},
+			[]uint64{MinerWorkloadThreshold + 10, large, MinerWorkloadThreshold + 10},
+			[]requestKey{{2, 0}},
+			[]requestKey{{1, 0}, {3, 0}, {1, 0}, {3, 0}},
+			true,
+		},
+	} {
+		resetState(t)
+		addMiner(9, 0)
+		for i, key := range test.requests {
+			msg := bitcoin.NewRequest("hello", 0, test.upper[i])
+			msg.ID = key.id
+			scheduleRequest(key, msg)
+		}
+		for _, key := range test.lost {
+			delete(clients, key)
+		}
+		for i, key := range test.order {
+			workU := nextWorkUnit(9)
+			if workU == nil || workU.clientWorkFor != key {
+				t.Fatalf("%s: work unit %d is %s, expected one for %v", test.name, i, describeFor(workU), key)
+			}
+		}
+		if test.done {
+			if workU := nextWorkUnit(9); workU != nil {
+				t.Fatalf("%s: extra work unit %s", test.name, describeFor(workU))
+			}
+		}
+	}
+}
+
+func TestFairShareNewClient(t *testing.T) {
+	resetState(t)
+	addMiner(9, 0)
+	large := uint64(100 * MinerWorkloadThreshold)
+	scheduleRequest(requestKey{1, 0}, bitcoin.NewRequest("hello", 0, large))
+	for i := 0; i < 3; i++ {
+		nextWorkUnit(9)
+	}
+	// a client arriving late is served right after the clients already queued
+	scheduleRequest(requestKey{2, 0}, bitcoin.NewRequest("world", 0, large))
+	for i, key := range []requestKey{{1, 0}, {2, 0}, {1, 0}, {2, 0}} {
+		if workU := nextWorkUnit(9); workU == nil || workU.clientWorkFor != key {
+			t.Fatalf("Work unit %d is %s, expected one for %v", i, describeFor(workU), key)
+		}
+	}
+}
+
+// describe a work unit with the request it belongs to in a failure message
+func describeFor(workU *workUnit) string {
+	if workU == nil {
+		return describe(workU)
+	}
+	return describe(workU) + " for " + workU.clientWorkFor.String()
+}
+
+func TestPipelinedResults(t *testing.T) {
+	srv := resetState(t)
+	addMiner(1, 0)
+	addMiner(2, 0)
+	// the client pipelines a long request and a short one, on other data and nonces
+	requests := map[uint64]*bitcoin.Message{
+		1: bitcoin.NewRequest("hello", 0, 6*MinerWorkloadThreshold-1),
+		2: bitcoin.NewRequest("world", 1000000, 1000000+MinerWorkloadThreshold/2),
+	}
+	for _, id := range []uint64{1, 2} {
+		msg := *requests[id]
+		msg.ID = id
+		receive(3, &msg)
+	}
+
+	// the miners report the hash of the first nonce of their work units
+	for rounds := 0; len(clients) > 0; rounds++ {
+		if rounds == 100 {
+			t.Fatalf("Requests not done after %d rounds", rounds)
+		}
+		for minerId := 1; minerId <= 2; minerId++ {
+			if workU := nextWorkUnit(minerId); workU != nil {
+				workU.assignedAt = time.Now()
+				minerCurrWork[minerId] = workU
+			}
+		}
+		for minerId := 1; minerId <= 2; minerId++ {
+			if workU := minerCurrWork[minerId]; workU != nil {
+				lower := workU.workMsg.Lower
+				receive(minerId, resultOf(workU.workMsg.Data, lower, workU.workMsg.Upper, lower))
+			}
+		}
+	}
+
+	// the short request is done first, each result carries the ID of its request and a nonce of its own range
+	msgs := srv.written[3]
+	if len(msgs) != 2 {
+		t.Fatalf("Client got %v, expected two results", msgs)
+	}
+	for i, id := range []uint64{2, 1} {
+		msg, req := msgs[i], requests[id]
+		if msg.Type != bitcoin.Result || msg.ID != id || msg.Nonce < req.Lower || msg.Nonce > req.Upper ||
+			msg.Hash != bitcoin.Hash(req.Data, msg.Nonce) {
+			t.Fatalf("Result %d is %v, expected the result of request %d on %v", i, msg, id, req)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/cmu440/bitcoin"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// kinds of journal records
+const (
+	opRequest  = "request"  // a request was scheduled
+	opDone     = "done"     // a subrange of a request was hashed
+	opFinished = "finished" // the result of a request was sent to its client
+)
+
+// record of the journal, one JSON object per line
+type journalRecord struct {
+	Op           string
+	Run, Conn    int
+	ID           uint64
+	Data         string `json:",omitempty"`
+	Lower, Upper uint64
+	Target       uint64 `json:",omitempty"`
+	Hash, Nonce  uint64
+	Time         int64 // unix time the record was written, compacted records keep the time of their request
+}
+
+// range of nonces from lower to upper
+type nonceRange struct {
+	lower, upper uint64
+}
+
+// identity of a journaled request: the connection the request came in on and its ID. IDs are
+// chosen by clients, so different clients may use the same ID. connection IDs start over when the
+// server restarts, so the connection is identified by the run of the server as well
+type journalKey struct {
+	run, conn int
+	id        uint64
+}
+
+// state of an unfinished request, as recorded in the journal
+type journaledRequest struct {
+	request        *bitcoin.Message
+	done           []nonceRange // sorted and merged subranges hashed so far
+	minHash, nonce uint64       // best result among the nonces hashed so far, see betterResult
+	owned          bool         // a client request is working on it, it can't be resumed by another one
+	updated        time.Time    // time of the latest record of the request
+}
+
+// journal of the requests with an ID, so that they survive a restart of the server and a
+// reconnect of their client. records are appended to the file as the work progresses, the
+// file is compacted to the unfinished requests when it is opened. requests whose client does
+// not come back expire after journalExpiry
+type journal struct {
+	file     *os.File
+	run      int                              // run of the server, one more than the runs in the file
+	requests map[journalKey]*journaledRequest // unfinished requests
+}
+
+// open the journal at path, loading the unfinished requests recorded in it
+func openJournal(path string) (*journal, error) {
+	j := &journal{requests: make(map[journalKey]*journaledRequest)}
+	if file, err := os.Open(path); err == nil {
+		err = j.load(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	j.run += 1
+
+	// rewrite the journal with the unfinished requests only, so that it does not grow with every restart
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	err = j.writeRequests()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// write one request record and one done record per hashed subrange of every unfinished request.
+// the records keep the time of the latest record of their request, and requests with no record
+// for journalExpiry are dropped
+func (j *journal) writeRequests() error {
+	for key, req := range j.requests {
+		if time.Since(req.updated) > journalExpiry {
+			delete(j.requests, key)
+			continue
+		}
+		msg := req.request
+		updated := req.updated.Unix()
+		record := &journalRecord{Op: opRequest, Run: key.run, Conn: key.conn, ID: key.id,
+			Data: msg.Data, Lower: msg.Lower, Upper: msg.Upper, Target: msg.Target, Time: updated}
+		if err := j.write(record); err != nil {
+			return err
+		}
+		for i, r := range req.done {
+			// the minimum hash is recorded once, with the first subrange
+			record := &journalRecord{Op: opDone, Run: key.run, Conn: key.conn, ID: key.id,
+				Lower: r.lower, Upper: r.upper, Hash: math.MaxUint64, Time: updated}
+			if i == 0 {
+				record.Hash, record.Nonce = req.minHash, req.nonce
+			}
+			if err := j.write(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay the records of a journal file, and find the latest run of the server recorded in it.
+// a record cut short by a crash, or otherwise corrupt, is skipped and dropped by the compaction
+func (j *journal) load(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		record := &journalRecord{}
+		if len(line) > 0 && json.Unmarshal(line, record) == nil {
+			j.replay(record)
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// apply a record of a journal file to the unfinished requests
+func (j *journal) replay(record *journalRecord) {
+	if record.Run > j.run {
+		j.run = record.Run
+	}
+	key := journalKey{record.Run, record.Conn, record.ID}
+	switch record.Op {
+	case opRequest:
+		j.requests[key] = &journaledRequest{
+			request: bitcoin.NewTargetRequest(record.Data, record.Lower, record.Upper, record.Target),
+			minHash: math.MaxUint64,
+			updated: time.Unix(record.Time, 0),
+		}
+	case opDone:
+		if req := j.requests[key]; req != nil {
+			req.addDone(record.Lower, record.Upper, record.Hash, record.Nonce)
+			req.updated = time.Unix(record.Time, 0)
+		}
+	case opFinished:
+		delete(j.requests, key)
+	}
+}
+
+// append a record to the journal file. the file is not synced, so records survive a crash of
+// the server but not of the machine
+func (j *journal) write(record *journalRecord) error {
+	if record.Time == 0 {
+		record.Time = time.Now().Unix()
+	}
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(buf, '\n'))
+	return err
+}
+
+// find an unfinished request with the ID of msg which no client request is working on, so that msg
+// resumes it. the data, range and target of msg must match those of the journaled request, false is
+// returned if the ID is only found with others
+func (j *journal) find(msg *bitcoin.Message) (journalKey, *journaledRequest, bool) {
+	matched := true
+	for key, req := range j.requests {
+		if key.id != msg.ID || req.owned {
+			continue
+		}
+		if req.request.Data == msg.Data && req.request.Lower == msg.Lower &&
+			req.request.Upper == msg.Upper && req.request.Target == msg.Target {
+			return key, req, true
+		}
+		matched = false
+	}
+	return journalKey{}, nil, matched
+}
+
+// record a new request of the client on the given connection, and return its key in the journal
+func (j *journal) logRequest(connId int, msg *bitcoin.Message) (journalKey, error) {
+	key := journalKey{j.run, connId, msg.ID}
+	j.requests[key] = &journaledRequest{
+		request: bitcoin.NewTargetRequest(msg.Data, msg.Lower, msg.Upper, msg.Target),
+		minHash: math.MaxUint64,
+		owned:   true,
+		updated: time.Now(),
+	}
+	return key, j.write(&journalRecord{Op: opRequest, Run: key.run, Conn: key.conn, ID: key.id,
+		Data: msg.Data, Lower: msg.Lower, Upper: msg.Upper, Target: msg.Target})
+}
+
+// record that the nonces from lower to upper of a request are hashed, with their minimum hash
+func (j *journal) logDone(key journalKey, lower, upper, hash, nonce uint64) error {
+	req := j.requests[key]
+	if req == nil {
+		return nil
+	}
+	req.addDone(lower, upper, hash, nonce)
+	req.updated = time.Now()
+	return j.write(&journalRecord{Op: opDone, Run: key.run, Conn: key.conn, ID: key.id,
+		Lower: lower, Upper: upper, Hash: hash, Nonce: nonce})
+}
+
+// record that the result of a request was sent to its client, or that its client cancelled it
+func (j *journal) logFinished(key journalKey) error {
+	if j.requests[key] == nil {
+		return nil
+	}
+	delete(j.requests, key)
+	return j.write(&journalRecord{Op: opFinished, Run: key.run, Conn: key.conn, ID: key.id})
+}
+
+// let another client request resume a request whose client is lost
+func (j *journal) release(key journalKey) {
+	if req := j.requests[key]; req != nil {
+		req.owned = false
+	}
+}
+
+// merge a hashed subrange into the done subranges of a request
+func (req *journaledRequest) addDone(lower, upper, hash, nonce uint64) {
+	if betterResult(req.request.Target, hash, nonce, req.minHash, req.nonce) {
+		req.minHash, req.nonce = hash, nonce
+	}
+	ranges := append(req.done, nonceRange{lower, upper})
+	sort.Slice(ranges, func(a, b int) bool { return ranges[a].lower < ranges[b].lower })
+	req.done = ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &req.done[len(req.done)-1]
+		if last.upper == math.MaxUint64 || r.lower <= last.upper+1 {
+			if r.upper > last.upper {
+				last.upper = r.upper
+			}
+		} else {
+			req.done = append(req.done, r)
+		}
+	}
+}
+
+// return the subranges of a request not hashed yet, in order
+func (req *journaledRequest) remaining() []nonceRange {
+	var gaps []nonceRange
+	next, upper := req.request.Lower, req.request.Upper
+	for _, r := range req.done {
+		if r.lower > next {
+			gaps = append(gaps, nonceRange{next, r.lower - 1})
+		}
+		if r.upper >= upper {
+			return gaps
+		}
+		if r.upper+1 > next {
+			next = r.upper + 1
+		}
+	}
+	return append(gaps, nonceRange{next, upper})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+func TestAddDoneAndRemaining(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		lower, upper uint64
+		done         []nonceRange // in the order they are hashed
+		merged       []nonceRange
+		remaining    []nonceRange
+	}{
+		{"nothing done", 0, 99, nil, nil, []nonceRange{{0, 99}}},
+		{"prefix", 0, 99, []nonceRange{{0, 9}}, []nonceRange{{0, 9}}, []nonceRange{{10, 99}}},
+		{"adjacent", 0, 99, []nonceRange{{10, 19}, {0, 9}, {20, 29}}, []nonceRange{{0, 29}}, []nonceRange{{30, 99}}},
+		{"overlapping", 0, 99, []nonceRange{{0, 15}, {10, 29}, {12, 20}}, []nonceRange{{0, 29}}, []nonceRange{{30, 99}}},
+		{"gaps", 5, 99, []nonceRange{{50, 59}, {20, 29}},
+			[]nonceRange{{20, 29}, {50, 59}}, []nonceRange{{5, 19}, {30, 49}, {60, 99}}},
+		{"suffix", 0, 99, []nonceRange{{90, 99}, {0, 9}}, []nonceRange{{0, 9}, {90, 99}}, []nonceRange{{10, 89}}},
+		{"all done", 0, 99, []nonceRange{{50, 99}, {0, 49}}, []nonceRange{{0, 99}}, nil},
+		{"up to the largest nonce", 0, math.MaxUint64, []nonceRange{{10, math.MaxUint64}, {5, 20}},
+			[]nonceRange{{5, math.MaxUint64}}, []nonceRange{{0, 4}}},
+	} {
+		req := &journaledRequest{request: bitcoin.NewRequest("hello", test.lower, test.upper), minHash: math.MaxUint64}
+		for i, r := range test.done {
+			// the minimum hash is found in the second subrange hashed
+			hash := uint64(100)
+			if i == 1 {
+				hash = 10
+			}
+			req.addDone(r.lower, r.upper, hash, r.lower)
+		}
+		if !reflect.DeepEqual(req.done, test.merged) {
+			t.Errorf("%s: done %v, expected %v", test.name, req.done, test.merged)
+		}
+		if remaining := req.remaining(); !reflect.DeepEqual(remaining, test.remaining) {
+			t.Errorf("%s: remaining %v, expected %v", test.name, remaining, test.remaining)
+		}
+		if len(test.done) > 1 && (req.minHash != 10 || req.nonce != test.done[1].lower) {
+			t.Errorf("%s: minimum hash %d of nonce %d, expected 10 of nonce %d",
+				test.name, req.minHash, req.nonce, test.done[1].lower)
+		}
+	}
+}
+
+// open the journal at path, failing the test if it can't be
+func mustOpenJournal(t *testing.T, path string) *journal {
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %s", err)
+	}
+	t.Cleanup(func() { j.file.Close() })
+	return j
+}
+
+func TestJournalReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	j := mustOpenJournal(t, path)
+	msg := bitcoin.NewTargetRequest("hello", 0, 999, 500)
+	msg.ID = 7
+	key, _ := j.logRequest(1, msg)
+	j.logDone(key, 100, 199, 300, 150)
+	j.logDone(key, 0, 49, 600, 20)
+	finished, _ := j.logRequest(2, bitcoin.NewRequest("world", 0, 10))
+	j.logFinished(finished)
+	j.file.Close()
+
+	for run := 2; run <= 3; run++ {
+		j = mustOpenJournal(t, path)
+		if j.run != run {
+			t.Fatalf("Run %d after reopening the journal, expected %d", j.run, run)
+		}
+		if len(j.requests) != run-1 {
+			t.Fatalf("%d unfinished requests journaled, expected %d", len(j.requests), run-1)
+		}
+		// the request is owned by no client request after a restart, so it is resumed
+		resumed, req, matched := j.find(msg)
+		if req == nil || !matched || resumed != key {
+			t.Fatalf("Request %v not resumed after a restart", key)
+		}
+		if !reflect.DeepEqual(req.done, []nonceRange{{0, 49}, {100, 199}}) || req.minHash != 300 || req.nonce != 150 {
+			t.Fatalf("Resumed with %v done and minimum hash %d of nonce %d", req.done, req.minHash, req.nonce)
+		}
+		// connection IDs start over, the run tells the requests of different runs apart
+		if next, _ := j.logRequest(1, &bitcoin.Message{ID: uint64(run), Data: "world"}); next.run != run {
+			t.Fatalf("Request logged with key %v in run %d", next, run)
+		}
+		j.file.Close()
+	}
+
+	// a record cut short by a crash is ignored
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, perm)
+	if err != nil {
+		t.Fatalf("Failed to open journal file: %s", err)
+	}
+	file.WriteString(`{"Op":"finished","Run":1,"Con`)
+	file.Close()
+	if _, req, _ := mustOpenJournal(t, path).find(msg); req == nil {
+		t.Fatalf("Request %v lost after a record cut short", key)
+	}
+}
+
+// write the given records to a journal file, each followed by the given line
+func writeJournal(t *testing.T, path string, records []*journalRecord, lines []string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create journal file: %s", err)
+	}
+	defer file.Close()
+	for i, record := range records {
+		buf, _ := json.Marshal(record)
+		file.Write(append(buf, '\n'))
+		file.WriteString(lines[i])
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	now := time.Now().Unix()
+	writeJournal(t, path, []*journalRecord{
+		{Op: opRequest, Run: 1, Conn: 1, ID: 7, Data: "hello", Upper: 999, Time: now},
+		{Op: opDone, Run: 1, Conn: 1, ID: 7, Lower: 0, Upper: 99, Hash: 300, Nonce: 42, Time: now},
+		{Op: opDone, Run: 1, Conn: 1, ID: 7, Lower: 100, Upper: 199, Hash: 200, Nonce: 150, Time: now},
+	}, []string{
+		"not a record\n",
+		`{"Op":"done","Run":1,"Conn":1,"ID":7,"Lower":200,"Upper":299,"Hash":1,"Nonce":` + "\n",
+		`{"Op":"finished","Run":1,"Con`,
+	})
+
+	// the corrupt records are skipped, the others are replayed
+	for i := 0; i < 2; i++ {
+		j := mustOpenJournal(t, path)
+		_, req, _ := j.find(&bitcoin.Message{ID: 7, Data: "hello", Upper: 999})
+		if req == nil || !reflect.DeepEqual(req.done, []nonceRange{{0, 199}}) || req.nonce != 150 {
+			t.Fatalf("Journal with corrupt records reopened %d times: request %+v", i, req)
+		}
+		j.file.Close()
+	}
+}
+
+func TestJournalExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	now, old := time.Now().Unix(), time.Now().Add(-journalExpiry-time.Hour).Unix()
+	writeJournal(t, path, []*journalRecord{
+		{Op: opRequest, Run: 1, Conn: 1, ID: 7, Data: "hello", Upper: 999, Time: old},
+		{Op: opRequest, Run: 1, Conn: 2, ID: 8, Data: "hello", Upper: 999, Time: old},
+		// the request got a work unit done recently, it does not expire
+		{Op: opDone, Run: 1, Conn: 2, ID: 8, Lower: 0, Upper: 99, Hash: 300, Nonce: 42, Time: now},
+		{Op: opRequest, Run: 1, Conn: 3, ID: 9, Data: "hello", Upper: 999, Time: now},
+	}, []string{"", "", "", ""})
+
+	// the compacted journal keeps the times of the requests, so they do not expire later than they should
+	for i := 0; i < 2; i++ {
+		j := mustOpenJournal(t, path)
+		for id, expired := range map[uint64]bool{7: true, 8: false, 9: false} {
+			if _, req, _ := j.find(&bitcoin.Message{ID: id, Data: "hello", Upper: 999}); (req == nil) != expired {
+				t.Fatalf("Journal reopened %d times: request %d expired %v, expected %v", i, id, req == nil, expired)
+			}
+		}
+		j.file.Close()
+	}
+	buf, _ := ioutil.ReadFile(path)
+	if n := strings.Count(string(buf), "\n"); n != 3 {
+		t.Fatalf("%d records in the compacted journal, expected 3", n)
+	}
+}
+
+func TestJournalFind(t *testing.T) {
+	j := mustOpenJournal(t, filepath.Join(t.TempDir(), journalName))
+	msg := bitcoin.NewTargetRequest("hello", 0, 999, 500)
+	msg.ID = 7
+	owned, _ := j.logRequest(1, msg)
+	for _, test := range []struct {
+		name            string
+		msg             *bitcoin.Message
+		released, found bool
+		matched         bool
+	}{
+		{"owned", msg, false, false, true},
+		{"released", msg, true, true, true},
+		{"other ID", &bitcoin.Message{ID: 8, Data: "hello", Upper: 999, Target: 500}, true, false, true},
+		{"other data", &bitcoin.Message{ID: 7, Data: "world", Upper: 999, Target: 500}, true, false, false},
+		{"other range", &bitcoin.Message{ID: 7, Data: "hello", Upper: 998, Target: 500}, true, false, false},
+		{"other target", &bitcoin.Message{ID: 7, Data: "hello", Upper: 999}, true, false, false},
+	} {
+		j.requests[owned].owned = !test.released
+		key, req, matched := j.find(test.msg)
+		if (req != nil) != test.found || matched != test.matched || (test.found && key != owned) {
+			t.Errorf("%s: found %v with key %v and matched %v, expected found %v and matched %v",
+				test.name, req != nil, key, matched, test.found, test.matched)
+		}
+	}
+}
+
+// replace the journal of the server with the one at path
+func useJournal(t *testing.T, path string) {
+	requestJournal.file.Close()
+	requestJournal = mustOpenJournal(t, path)
+}
+
+func TestScheduleRequestResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	j := mustOpenJournal(t, path)
+	msg := bitcoin.NewRequest("hello", 0, 99999)
+	msg.ID = 7
+	key, _ := j.logRequest(1, msg)
+	// the work units of two miners were hashed, one more was in progress when the server stopped
+	j.logDone(key, 0, 9999, 300, 42)
+	j.logDone(key, 20000, 29999, 200, 25000)
+	j.file.Close()
+
+	resetState(t)
+	useJournal(t, path)
+	addMiner(9, 0)
+	scheduleRequest(requestKey{1, 7}, msg)
+	status := clients[requestKey{1, 7}]
+	if status.journaled != key || !requestJournal.requests[key].owned {
+		t.Fatalf("Journaled request %v not resumed", key)
+	}
+	if status.minHash != 200 || status.nonce != 25000 {
+		t.Fatalf("Resumed with minimum hash %d of nonce %d, expected 200 of nonce 25000", status.minHash, status.nonce)
+	}
+	// the gap is handed out first, then the rest of the range
+	for i, unit := range [][2]uint64{{10000, 19999}, {30000, 39999}} {
+		workU := nextWorkUnit(9)
+		if workU == nil || workU.workMsg.Lower != unit[0] || workU.workMsg.Upper != unit[1] {
+			t.Fatalf("Work unit %d is %s, expected nonces %d to %d", i, describe(workU), unit[0], unit[1])
+		}
+	}
+
+	// another request with the ID starts over, as the journaled one is taken
+	scheduleRequest(requestKey{2, 7}, msg)
+	if status := clients[requestKey{2, 7}]; status.journaled == key || status.minHash != math.MaxUint64 {
+		t.Fatalf("Request with a taken ID resumed %v", status.journaled)
+	}
+}
+
+func TestScheduleRequestMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	j := mustOpenJournal(t, path)
+	msg := bitcoin.NewRequest("hello", 0, 99999)
+	msg.ID = 7
+	key, _ := j.logRequest(1, msg)
+	j.logDone(key, 0, 9999, 300, 42)
+	j.file.Close()
+
+	resetState(t)
+	useJournal(t, path)
+	other := bitcoin.NewRequest("world", 0, 99999)
+	other.ID = 7
+	scheduleRequest(requestKey{1, 7}, other)
+	status := clients[requestKey{1, 7}]
+	if status.journaled == key || status.nextLower != 0 || status.minHash != math.MaxUint64 {
+		t.Fatalf("Request with other data resumed %v", key)
+	}
+	// the journaled request is left for a client sending the matching request
+	if _, req, _ := requestJournal.find(msg); req == nil {
+		t.Fatalf("Journaled request %v taken by a request with other data", key)
+	}
+}
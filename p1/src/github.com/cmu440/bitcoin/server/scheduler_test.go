@@ -0,0 +1,359 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+	"github.com/cmu440/lsp"
+)
+
+// LSP server which records the messages written to each connection and the closed connections.
+// the other methods are not used by the scheduler
+type fakeServer struct {
+	lsp.Server
+	written map[int][]*bitcoin.Message
+	closed  map[int]bool
+}
+
+func (s *fakeServer) Write(connId int, payload []byte) error {
+	msg := &bitcoin.Message{}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return err
+	}
+	s.written[connId] = append(s.written[connId], msg)
+	return nil
+}
+
+func (s *fakeServer) CloseConn(connId int) error {
+	s.closed[connId] = true
+	return nil
+}
+
+// reset the state of the server, with a fake LSP server and an empty journal
+func resetState(t *testing.T) *fakeServer {
+	srv := &fakeServer{written: make(map[int][]*bitcoin.Message), closed: make(map[int]bool)}
+	lspServer = srv
+	minerCurrWork = make(map[int]*workUnit)
+	unOccupiedMiner = make(map[int]bool)
+	minerHashRate = make(map[int]float64)
+	blacklisted = make(map[int]bool)
+	drained = make(map[int]bool)
+	clients = make(map[requestKey]*clientStatus)
+	clientQ = list.New()
+	requestQ = make(map[int]*list.List)
+	jobQ = list.New()
+	FLOG = log.New(ioutil.Discard, "", 0)
+	// results are spot checked only by the tests of spot checks
+	*spotCheckPercent = 0
+	var err error
+	requestJournal, err = openJournal(filepath.Join(t.TempDir(), journalName))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %s", err)
+	}
+	t.Cleanup(func() { requestJournal.file.Close() })
+	return srv
+}
+
+// register an idle miner with the given hash rate, 0 if not measured yet
+func addMiner(minerId int, hashRate float64) {
+	minerCurrWork[minerId] = nil
+	unOccupiedMiner[minerId] = true
+	if hashRate > 0 {
+		minerHashRate[minerId] = hashRate
+	}
+}
+
+// give a miner a work unit of a client request, which it reported hashed the given number of nonces of
+func assignWork(minerId int, key requestKey, lower, upper, hashed uint64) *workUnit {
+	workU := &workUnit{
+		clientWorkFor: key,
+		workMsg:       bitcoin.NewRequest(clients[key].data, lower, upper),
+		assignedAt:    time.Now(),
+		hashed:        hashed,
+		progressAt:    time.Now(),
+	}
+	minerCurrWork[minerId] = workU
+	delete(unOccupiedMiner, minerId)
+	clients[key].notFinishedJob += 1
+	return workU
+}
+
+// describe a work unit in a failure message, which may be missing
+func describe(workU *workUnit) string {
+	if workU == nil {
+		return "nothing"
+	}
+	return workU.workMsg.String()
+}
+
+func TestChunkSize(t *testing.T) {
+	for _, test := range []struct {
+		hashRate float64
+		size     uint64
+	}{
+		{0, MinerWorkloadThreshold},
+		{MinerWorkloadThreshold / 2, MinerWorkloadThreshold},
+		{MinerWorkloadThreshold, MinerWorkloadThreshold},
+		{2500000, 2500000 * ChunkMillis / 1000},
+	} {
+		resetState(t)
+		addMiner(1, test.hashRate)
+		if size := chunkSize(1); size != test.size {
+			t.Errorf("chunkSize at %.0f hashes/s = %d, expected %d", test.hashRate, size, test.size)
+		}
+	}
+}
+
+func TestNextWorkUnit(t *testing.T) {
+	for _, test := range []struct {
+		hashRate     float64
+		lower, upper uint64
+		units        [][2]uint64
+	}{
+		// the last work unit takes the rest, however small
+		{0, 0, 25000, [][2]uint64{{0, 9999}, {10000, 19999}, {20000, 25000}}},
+		// a range one nonce longer than a work unit is not split off a single nonce
+		{0, 5, 10005, [][2]uint64{{5, 10004}, {10005, 10005}}},
+		{0, 0, 9999, [][2]uint64{{0, 9999}}},
+		{0, 7, 7, [][2]uint64{{7, 7}}},
+		// work units follow the hash rate of the miner
+		{30000, 0, 70000, [][2]uint64{{0, 29999}, {30000, 59999}, {60000, 70000}}},
+	} {
+		resetState(t)
+		addMiner(1, test.hashRate)
+		key := requestKey{2, 0}
+		scheduleRequest(key, bitcoin.NewRequest("hello", test.lower, test.upper))
+		for i, unit := range test.units {
+			workU := nextWorkUnit(1)
+			if workU == nil {
+				t.Fatalf("Range %d to %d: work unit %d missing", test.lower, test.upper, i)
+			}
+			if workU.clientWorkFor != key || workU.workMsg.Lower != unit[0] || workU.workMsg.Upper != unit[1] {
+				t.Fatalf("Range %d to %d: work unit %d is %v for %v, expected nonces %d to %d for %v",
+					test.lower, test.upper, i, workU.workMsg, workU.clientWorkFor, unit[0], unit[1], key)
+			}
+		}
+		if workU := nextWorkUnit(1); workU != nil {
+			t.Fatalf("Range %d to %d: extra work unit %v", test.lower, test.upper, workU.workMsg)
+		}
+		if status := clients[key]; !status.allAssigned || status.notFinishedJob != len(test.units) {
+			t.Fatalf("Range %d to %d: all assigned %v with %d work units in progress, expected true with %d",
+				test.lower, test.upper, status.allAssigned, status.notFinishedJob, len(test.units))
+		}
+	}
+}
+
+func TestNextWorkUnitJobQueue(t *testing.T) {
+	resetState(t)
+	addMiner(1, 0)
+	addMiner(2, 0)
+	key, lost := requestKey{3, 0}, requestKey{4, 0}
+	scheduleRequest(key, bitcoin.NewRequest("hello", 0, 100000))
+	requeued := &workUnit{clientWorkFor: key, workMsg: bitcoin.NewRequest("hello", 50, 60)}
+	check := &workUnit{clientWorkFor: key, workMsg: bitcoin.NewRequest("hello", 0, 40),
+		check: &spotCheck{minerId: 1, minHash: 5, nonce: 6}}
+	jobQ.PushBack(&workUnit{clientWorkFor: lost, workMsg: bitcoin.NewRequest("bye", 0, 10)})
+	jobQ.PushBack(check)
+	jobQ.PushBack(requeued)
+
+	// the work unit of a lost client is dropped, and miner 1 does not check its own result
+	if workU := nextWorkUnit(1); workU != requeued {
+		t.Fatalf("Miner 1 got %s, expected the requeued work unit", describe(workU))
+	}
+	if workU := nextWorkUnit(1); workU == nil || workU.check != nil || workU.workMsg.Lower != 0 {
+		t.Fatalf("Miner 1 got %s, expected the first work unit of the request", describe(workU))
+	}
+	if workU := nextWorkUnit(2); workU != check {
+		t.Fatalf("Miner 2 got %s, expected the spot check of miner 1", describe(workU))
+	}
+	if jobQ.Len() != 0 {
+		t.Fatalf("%d work units left in the job queue, expected none", jobQ.Len())
+	}
+}
+
+func TestNextWorkUnitDropsCheckOfLastMiner(t *testing.T) {
+	resetState(t)
+	addMiner(1, 0)
+	key := requestKey{3, 0}
+	scheduleRequest(key, bitcoin.NewRequest("hello", 0, 40))
+	jobQ.PushBack(&workUnit{clientWorkFor: key, workMsg: bitcoin.NewRequest("hello", 0, 40),
+		check: &spotCheck{minerId: 1, minHash: 5, nonce: 6}})
+	clients[key].notFinishedJob += 1
+
+	// nobody else can check miner 1, so the check is dropped and miner 1 gets the request instead
+	workU := nextWorkUnit(1)
+	if workU == nil || workU.check != nil {
+		t.Fatalf("Miner 1 got %s, expected the request", describe(workU))
+	}
+	if jobQ.Len() != 0 || clients[key].notFinishedJob != 1 {
+		t.Fatalf("%d work units queued and %d in progress, expected 0 and 1", jobQ.Len(), clients[key].notFinishedJob)
+	}
+}
+
+func TestStealWork(t *testing.T) {
+	for _, test := range []struct {
+		name                  string
+		thiefRate, victimRate float64
+		lower, upper, hashed  uint64
+		check                 bool
+		split                 uint64 // first nonce of the thief, 0 if nothing is stolen
+	}{
+		{"even split", 0, 0, 0, 999999, 200000, false, 600001},
+		{"no progress", 0, 0, 1000, 100999, 0, false, 51001},
+		{"by hash rate", 3, 1, 0, 399999, 0, false, 100001},
+		{"small tail", 0, 0, 0, 999999, 999999 - 2*MinerWorkloadThreshold + 2, false, 0},
+		{"spot check", 0, 0, 0, 999999, 0, true, 0},
+	} {
+		srv := resetState(t)
+		addMiner(1, test.victimRate)
+		addMiner(2, test.thiefRate)
+		key := requestKey{3, 0}
+		scheduleRequest(key, bitcoin.NewRequest("hello", test.lower, test.upper))
+		clients[key].allAssigned = true
+		victimWork := assignWork(1, key, test.lower, test.upper, test.hashed)
+		if test.check {
+			victimWork.check = &spotCheck{minerId: 4}
+		}
+
+		workU := stealWork(2)
+		if test.split == 0 {
+			if workU != nil || len(srv.written[1]) != 0 {
+				t.Errorf("%s: stole %s, expected nothing", test.name, describe(workU))
+			}
+			continue
+		}
+		if workU == nil {
+			t.Errorf("%s: stole nothing, expected nonces %d to %d", test.name, test.split, test.upper)
+			continue
+		}
+		if workU.clientWorkFor != key || workU.workMsg.Lower != test.split || workU.workMsg.Upper != test.upper {
+			t.Errorf("%s: stole %v, expected nonces %d to %d", test.name, workU.workMsg, test.split, test.upper)
+		}
+		if victimWork.workMsg.Lower != test.lower || victimWork.workMsg.Upper != test.split-1 {
+			t.Errorf("%s: victim left with %v, expected nonces %d to %d", test.name, victimWork.workMsg, test.lower, test.split-1)
+		}
+		if msgs := srv.written[1]; len(msgs) != 1 || msgs[0].Type != bitcoin.Truncate || msgs[0].Upper != test.split-1 {
+			t.Errorf("%s: victim sent %v, expected a truncate at %d", test.name, msgs, test.split-1)
+		}
+		if n := clients[key].notFinishedJob; n != 2 {
+			t.Errorf("%s: %d work units in progress, expected 2", test.name, n)
+		}
+	}
+}
+
+func TestStealWorkPicksLargestTail(t *testing.T) {
+	resetState(t)
+	for minerId := 1; minerId <= 3; minerId++ {
+		addMiner(minerId, 0)
+	}
+	key, lost := requestKey{4, 0}, requestKey{5, 0}
+	scheduleRequest(key, bitcoin.NewRequest("hello", 0, math.MaxUint32))
+	scheduleRequest(lost, bitcoin.NewRequest("bye", 0, math.MaxUint32))
+	assignWork(1, key, 0, 99999, 0)
+	assignWork(2, key, 100000, 299999, 0)
+	// the largest tail belongs to a lost client, it is not worth stealing
+	assignWork(3, lost, 0, 999999, 0)
+	delete(clients, lost)
+
+	addMiner(6, 0)
+	workU := stealWork(6)
+	if workU == nil || workU.workMsg.Lower != 200001 || workU.workMsg.Upper != 299999 {
+		t.Fatalf("Stole %s, expected the tail of miner 2 from 200001 to 299999", describe(workU))
+	}
+}
+
+// progress message of a miner which hashed the nonces from lower to upper, reporting the given nonce
+func progressOf(data string, lower, upper, nonce uint64) *bitcoin.Message {
+	return bitcoin.NewProgress(data, lower, upper, bitcoin.Hash(data, nonce), nonce)
+}
+
+func TestUpdateProgress(t *testing.T) {
+	wrong := progressOf("hello", 1000, 1499, 1200)
+	wrong.Hash += 1
+	for _, test := range []struct {
+		name        string
+		msg         *bitcoin.Message
+		hashed      uint64
+		nonce       uint64
+		blacklisted bool
+	}{
+		{"progress", progressOf("hello", 1000, 1499, 1200), 500, 1200, false},
+		{"other data", progressOf("world", 1000, 1499, 1200), 100, 1050, false},
+		{"other lower", progressOf("hello", 500, 1499, 1200), 100, 1050, false},
+		{"older progress", progressOf("hello", 1000, 1049, 1020), 100, 1050, false},
+		{"past the upper end", progressOf("hello", 1000, 2999, 2500), 1000, 2500, false},
+		// the work unit of a blacklisted miner is hashed again as a whole
+		{"wrong hash", wrong, 0, 1050, true},
+	} {
+		resetState(t)
+		addMiner(1, 0)
+		key := requestKey{2, 0}
+		scheduleRequest(key, bitcoin.NewRequest("hello", 0, 99999))
+		// the miner reported the first 100 nonces of its work unit before
+		workU := assignWork(1, key, 1000, 1999, 100)
+		workU.minHash, workU.nonce = bitcoin.Hash("hello", 1050), 1050
+
+		updateProgress(1, test.msg)
+		if workU.hashed != test.hashed || workU.nonce != test.nonce || workU.minHash != bitcoin.Hash("hello", test.nonce) {
+			t.Errorf("%s: %d nonces hashed with minimum at nonce %d, expected %d with minimum at nonce %d",
+				test.name, workU.hashed, workU.nonce, test.hashed, test.nonce)
+		}
+		if blacklisted[1] != test.blacklisted {
+			t.Errorf("%s: miner blacklisted %v, expected %v", test.name, blacklisted[1], test.blacklisted)
+		}
+	}
+}
+
+func TestRequeueWork(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		upper    uint64 // upper end of the work unit, after a truncate
+		progress uint64 // upper end of the nonces reported hashed, 0 if none
+		requeued []nonceRange
+		done     []nonceRange
+	}{
+		{"no progress", 9999, 0, []nonceRange{{0, 9999}}, nil},
+		{"progress", 9999, 4999, []nonceRange{{5000, 9999}}, []nonceRange{{0, 4999}}},
+		{"progress past a truncate", 4999, 7999, nil, []nonceRange{{0, 4999}}},
+	} {
+		resetState(t)
+		addMiner(1, 0)
+		key := requestKey{2, 7}
+		msg := bitcoin.NewRequest("hello", 0, 99999)
+		msg.ID = 7
+		scheduleRequest(key, msg)
+		status := clients[key]
+		assignWork(1, key, 0, test.upper, 0)
+		best := uint64(0)
+		if test.progress > 0 {
+			best, _ = minNonces("hello", 0, test.progress)
+			updateProgress(1, progressOf("hello", 0, test.progress, best))
+		}
+
+		handleFailure(1)
+		var requeued []nonceRange
+		for e := jobQ.Front(); e != nil; e = e.Next() {
+			workU := e.Value.(*workUnit)
+			requeued = append(requeued, nonceRange{workU.workMsg.Lower, workU.workMsg.Upper})
+		}
+		if !reflect.DeepEqual(requeued, test.requeued) || status.notFinishedJob != len(test.requeued) {
+			t.Errorf("%s: requeued %v with %d work units in progress, expected %v", test.name, requeued,
+				status.notFinishedJob, test.requeued)
+		}
+		// the minimum hash among the nonces reported hashed counts for the request right away
+		if done := requestJournal.requests[status.journaled].done; !reflect.DeepEqual(done, test.done) {
+			t.Errorf("%s: journaled %v done, expected %v", test.name, done, test.done)
+		}
+		if test.progress > 0 && (status.nonce != best || status.minHash != bitcoin.Hash("hello", best)) {
+			t.Errorf("%s: minimum hash of the request at nonce %d, expected %d", test.name, status.nonce, best)
+		}
+	}
+}
@@ -3,30 +3,69 @@ package main
 import (
 	"container/list"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/cmu440/bitcoin"
 	"github.com/cmu440/lsp"
 	"log"
 	"math"
 	"os"
+	"sort"
 	"strconv"
+	"time"
 )
 
 const (
-	name                   = "log.txt"
-	flag                   = os.O_RDWR | os.O_CREATE
-	perm                   = os.FileMode(0666)
+	name    = "log.txt"
+	logFlag = os.O_RDWR | os.O_CREATE
+	perm    = os.FileMode(0666)
+	// requests with an ID are journaled to this file, see journal
+	journalName = "journal.txt"
+	// journaled requests with no progress for this long are dropped when the journal is opened, their
+	// clients are not coming back for them
+	journalExpiry = 24 * time.Hour
+	// size of the first work unit of a miner, and the smallest work unit handed out
 	MinerWorkloadThreshold = 10000
+	// time a miner should take to finish a work unit, given its measured hash rate
+	ChunkMillis = 1000
+	// weight of the latest measurement in the hash rate of a miner
+	rateSmoothing = 0.5
 )
 
-// unit of work that a miner is responsible for, including the client that this job belongs to
+// a request of a client, identified by the connection of the client and the ID of the request.
+// a client can pipeline requests with different IDs on one connection
+type requestKey struct {
+	connId int
+	id     uint64
+}
+
+func (key requestKey) String() string {
+	return fmt.Sprintf("client %d request %d", key.connId, key.id)
+}
+
+// unit of work that a miner is responsible for, including the client request that this job belongs to
 type workUnit struct {
-	clientWorkFor int
-	workMsg       *bitcoin.Message
+	clientWorkFor  requestKey
+	workMsg        *bitcoin.Message
+	assignedAt     time.Time
+	hashed         uint64     // number of nonces from the lower end of the range the miner reported hashed
+	minHash, nonce uint64     // minimum hash among the nonces reported hashed
+	progressAt     time.Time  // time of the latest progress message of the miner
+	check          *spotCheck // if not nil, the work unit is a spot check of the result of another miner
+	cancelled      bool       // the work unit is not needed anymore, the result of its miner is ignored
 }
 
+// status of a client's request. the nonces from nextLower to upper are not handed out yet
 type clientStatus struct {
-	notFinishedJob int
+	data           string
+	lower          uint64
+	nextLower      uint64
+	upper          uint64
+	allAssigned    bool
+	notFinishedJob int        // number of work units handed out and not finished yet
+	target         uint64     // the request is done at the first hash found below target, if not 0
+	id             uint64     // ID of the request, its result is tagged with it and it is journaled if not 0
+	journaled      journalKey // key of the request in the journal, if it is journaled
 	minHash        uint64
 	nonce          uint64
 }
@@ -34,18 +73,27 @@ type clientStatus struct {
 var (
 	minerCurrWork   map[int]*workUnit
 	unOccupiedMiner map[int]bool
-	clients         map[int]*clientStatus
-	jobQ            *list.List
+	minerHashRate   map[int]float64 // hashes per second of the miners measured so far
+	clients         map[requestKey]*clientStatus
+	clientQ         *list.List         // connection IDs of the clients with nonces not handed out yet, served round-robin
+	requestQ        map[int]*list.List // requests of each client in clientQ, served round-robin as well
+	jobQ            *list.List         // work units given back by lost miners, handed out first
+	requestJournal  *journal
 	lspServer       lsp.Server
 	FLOG            *log.Logger
 )
 
-// return an initialized ClientStatus for client, given the number of jobs partitioned for the request message
-func newClientStatus(partitionedJobNum int) *clientStatus {
+// return an initialized ClientStatus for client, given its request message
+func newClientStatus(msg *bitcoin.Message) *clientStatus {
 	return &clientStatus{
-		notFinishedJob: partitionedJobNum,
-		minHash:        math.MaxUint64,
-		nonce:          0,
+		data:      msg.Data,
+		lower:     msg.Lower,
+		nextLower: msg.Lower,
+		upper:     msg.Upper,
+		target:    msg.Target,
+		id:        msg.ID,
+		minHash:   math.MaxUint64,
+		nonce:     0,
 	}
 }
 
@@ -63,70 +111,431 @@ func sendMessage(connId int, msg *bitcoin.Message) error {
 	return nil
 }
 
-// partition/schedule request from a client
-// this function will evenly partition the calculation to all connected miner if (upper - lower > MinerWorkloadThreshold)
-// otherwise it will not partition the calculation but assign it to only one miner
-func partitionJob(connId int, msg *bitcoin.Message) {
-	data, lower, upper := msg.Data, msg.Lower, msg.Upper
-
-	if upper-lower+1 <= MinerWorkloadThreshold {
-		workU := &workUnit{
-			clientWorkFor: connId,
-			workMsg:       bitcoin.NewRequest(data, lower, upper),
+// schedule request from a client. the request is not partitioned up front, work units are cut off
+// its range as miners become free, sized according to the hash rate of the miner (see chunkSize).
+// a request with an ID found in the journal resumes from the nonces hashed before, unless the journaled
+// request with the ID has different data or range, then it starts over
+func scheduleRequest(key requestKey, msg *bitcoin.Message) {
+	status := newClientStatus(msg)
+	clients[key] = status
+	if msg.ID != 0 {
+		journaled, req, matched := requestJournal.find(msg)
+		if req != nil {
+			req.owned = true
+			status.journaled = journaled
+			resumeRequest(key, req)
+			return
+		}
+		if !matched {
+			FLOG.Printf("%v does not match the journaled request with its ID, not resumed\n", key)
 		}
-		jobQ.PushBack(workU)
-		clients[connId] = newClientStatus(1)
+		journaled, err := requestJournal.logRequest(key.connId, msg)
+		if err != nil {
+			FLOG.Println("cannot journal request: ", err)
+		}
+		status.journaled = journaled
+	}
+	queueRequest(key)
+	logQueueDepths()
+}
+
+// queue a client request with nonces not handed out yet. every client gets its fair share of the
+// miners, however many requests it pipelines, so the request queues behind the other requests of
+// its client, and the client behind the other clients
+func queueRequest(key requestKey) {
+	requests := requestQ[key.connId]
+	if requests == nil {
+		requests = list.New()
+		requestQ[key.connId] = requests
+		clientQ.PushBack(key.connId)
+	}
+	requests.PushBack(key)
+}
+
+// schedule the subranges of a journaled request which are not hashed yet. the gaps left by work
+// units in progress when the request was interrupted are handed out like the work units of lost
+// miners, the rest of the range like a new request
+func resumeRequest(key requestKey, req *journaledRequest) {
+	status := clients[key]
+	status.minHash, status.nonce = req.minHash, req.nonce
+	gaps := req.remaining()
+	FLOG.Printf("resume %v, %d subranges left\n", key, len(gaps))
+	if len(gaps) == 0 {
+		sendResult(key)
+		return
+	}
+	if last := gaps[len(gaps)-1]; last.upper == status.upper {
+		status.nextLower = last.lower
+		gaps = gaps[:len(gaps)-1]
+		queueRequest(key)
 	} else {
-		numOfMiner := len(minerCurrWork)
-		// if there is no miner at this moment, partition the job as if there is one miner
-		if numOfMiner == 0 {
-			numOfMiner = 1
-		}
-		clients[connId] = newClientStatus(numOfMiner)
-		interval := (upper - lower + 1) / uint64(numOfMiner)
-		// partition the job and push them into the job queue
-		for i := 0; i < numOfMiner; i++ {
-			currLower := lower + uint64(i)*interval
-			currUpeer := currLower + interval - 1
-			if i == numOfMiner-1 {
-				currUpeer = upper
-			}
-			workU := &workUnit{
-				clientWorkFor: connId,
-				workMsg:       bitcoin.NewRequest(data, currLower, currUpeer),
-			}
-			jobQ.PushBack(workU)
+		status.allAssigned = true
+	}
+	for _, gap := range gaps {
+		status.notFinishedJob += 1
+		jobQ.PushBack(&workUnit{
+			clientWorkFor: key,
+			workMsg:       bitcoin.NewTargetRequest(status.data, gap.lower, gap.upper, status.target),
+		})
+	}
+	// only the gaps below the nonce found before are still needed
+	if status.target != 0 && status.minHash < status.target {
+		cutRequest(key, status.nonce)
+		if status.notFinishedJob == 0 {
+			sendResult(key)
+			return
 		}
 	}
+	logQueueDepths()
+}
+
+// return the keys of the client requests, ordered by client and ID
+func sortedRequestKeys() []requestKey {
+	keys := make([]requestKey, 0, len(clients))
+	for key := range clients {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].connId != keys[j].connId {
+			return keys[i].connId < keys[j].connId
+		}
+		return keys[i].id < keys[j].id
+	})
+	return keys
+}
+
+// log the number of nonces not handed out yet and work units in progress of every client request
+func logQueueDepths() {
+	for _, key := range sortedRequestKeys() {
+		status := clients[key]
+		queued := uint64(0)
+		if !status.allAssigned {
+			queued = status.upper - status.nextLower + 1
+		}
+		FLOG.Printf("%v: %d nonces queued, %d work units in progress\n", key, queued, status.notFinishedJob)
+	}
+}
+
+// return the number of nonces a miner should get in its next work unit: as many as it hashes
+// in ChunkMillis, or MinerWorkloadThreshold if its hash rate is not measured yet
+func chunkSize(minerId int) uint64 {
+	size := uint64(minerHashRate[minerId] * ChunkMillis / 1000)
+	if size < MinerWorkloadThreshold {
+		size = MinerWorkloadThreshold
+	}
+	return size
+}
+
+// return the next work unit for a miner, from the work units given back by lost miners and the
+// spot checks of the results of other miners first, and otherwise cut off the range of the next
+// request of the client at the front of the client queue. the request then goes to the back of the
+// requests of the client, and the client to the back of the queue, so that every client with nonces
+// not handed out yet gets a work unit in turn, however large or many its requests are
+func nextWorkUnit(minerId int) *workUnit {
+	for e := jobQ.Front(); e != nil; {
+		next := e.Next()
+		workU := e.Value.(*workUnit)
+		// no need to do any computation for a lost client
+		if clients[workU.clientWorkFor] == nil {
+			jobQ.Remove(e)
+		} else if workU.check == nil || workU.check.minerId != minerId {
+			jobQ.Remove(e)
+			return workU
+		} else if activeMiners() == 1 {
+			// a miner does not check its own result, the check is dropped if no other miner is left
+			jobQ.Remove(e)
+			finishWork(workU, math.MaxUint64, 0)
+		}
+		e = next
+	}
+	for clientQ.Len() > 0 {
+		connId := clientQ.Front().Value.(int)
+		requests := requestQ[connId]
+		if requests.Len() == 0 {
+			delete(requestQ, connId)
+			clientQ.Remove(clientQ.Front())
+			continue
+		}
+		key := requests.Front().Value.(requestKey)
+		status := clients[key]
+		if status == nil || status.allAssigned {
+			requests.Remove(requests.Front())
+			continue
+		}
+		lower, upper := status.nextLower, status.upper
+		if size := chunkSize(minerId); upper-lower >= size {
+			upper = lower + size - 1
+			status.nextLower = upper + 1
+			requests.MoveToBack(requests.Front())
+		} else {
+			status.allAssigned = true
+			requests.Remove(requests.Front())
+		}
+		clientQ.MoveToBack(clientQ.Front())
+		status.notFinishedJob += 1
+		return &workUnit{
+			clientWorkFor: key,
+			workMsg:       bitcoin.NewTargetRequest(status.data, lower, upper, status.target),
+		}
+	}
+	return nil
+}
+
+// estimate the number of nonces of a work unit that a miner has not hashed yet, from its latest
+// progress message and the time since then
+func remainingWork(minerId int, workU *workUnit) uint64 {
+	lower, upper := workU.workMsg.Lower, workU.workMsg.Upper
+	since := workU.assignedAt
+	if workU.hashed > 0 {
+		since = workU.progressAt
+	}
+	done := workU.hashed + uint64(minerHashRate[minerId]*time.Since(since).Seconds())
+	if done > upper-lower {
+		return 0
+	}
+	return upper - lower - done
+}
+
+// steal the unfinished tail of the work unit of the miner with the most work left, when there is
+// nothing else to do for an idle miner. the tail is split according to the hash rates of both
+// miners, and the victim is told to stop where the thief starts with a truncate message. spot checks
+// are never split, their result is compared with the result of the whole range they check
+func stealWork(thiefId int) *workUnit {
+	victimId, victimWork, remaining := 0, (*workUnit)(nil), uint64(0)
+	for minerId, workU := range minerCurrWork {
+		if workU == nil || workU.check != nil || workU.cancelled || clients[workU.clientWorkFor] == nil {
+			continue
+		}
+		if r := remainingWork(minerId, workU); r > remaining {
+			victimId, victimWork, remaining = minerId, workU, r
+		}
+	}
+	// not worth the extra messages for a small tail
+	if victimWork == nil || remaining < 2*MinerWorkloadThreshold {
+		return nil
+	}
+
+	thiefRate, victimRate := minerHashRate[thiefId], minerHashRate[victimId]
+	share := remaining / 2
+	if thiefRate > 0 && victimRate > 0 {
+		share = uint64(float64(remaining) * thiefRate / (thiefRate + victimRate))
+	}
+	if share < MinerWorkloadThreshold {
+		return nil
+	}
+	data, lower, upper := victimWork.workMsg.Data, victimWork.workMsg.Lower, victimWork.workMsg.Upper
+	target := victimWork.workMsg.Target
+	split := upper - share + 1
+	if sendMessage(victimId, bitcoin.NewTruncate(data, lower, split-1)) != nil {
+		return nil
+	}
+	FLOG.Printf("miner %d steals nonces %d to %d from miner %d\n", thiefId, split, upper, victimId)
+	victimWork.workMsg = bitcoin.NewTargetRequest(data, lower, split-1, target)
+	clients[victimWork.clientWorkFor].notFinishedJob += 1
+	return &workUnit{
+		clientWorkFor: victimWork.clientWorkFor,
+		workMsg:       bitcoin.NewTargetRequest(data, split, upper, target),
+	}
+}
+
+// update the measured hash rate of a miner which hashed the given number of nonces since assignedAt
+func updateHashRate(minerId int, hashed uint64, assignedAt time.Time) {
+	elapsed := time.Since(assignedAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(hashed) / elapsed
+	if old, ok := minerHashRate[minerId]; ok {
+		rate = rateSmoothing*rate + (1-rateSmoothing)*old
+	}
+	minerHashRate[minerId] = rate
+	FLOG.Printf("miner %d hash rate: %.0f/s\n", minerId, rate)
+}
+
+// record the nonces a miner reported hashed so far in its current work unit. progress messages are
+// sent unreliably, so those of an earlier work unit or older than the latest one are ignored
+func updateProgress(connId int, msg *bitcoin.Message) {
+	workU := minerCurrWork[connId]
+	if workU == nil || msg.Data != workU.workMsg.Data || msg.Lower != workU.workMsg.Lower || msg.Upper < msg.Lower {
+		return
+	}
+	hashed := msg.Upper - msg.Lower + 1
+	// the miner may hash past a truncated work unit, the nonces past it belong to another one
+	if size := workU.workMsg.Upper - workU.workMsg.Lower + 1; hashed > size {
+		hashed = size
+	}
+	if hashed <= workU.hashed {
+		return
+	}
+	if !verifyResult(workU, msg) {
+		FLOG.Printf("wrong progress of miner %d: %v\n", connId, msg)
+		blacklistMiner(connId)
+		return
+	}
+	workU.hashed = hashed
+	workU.minHash, workU.nonce = msg.Hash, msg.Nonce
+	workU.progressAt = time.Now()
+}
+
+// put the work unit of a lost miner back to the job queue (at front). only the nonces the miner
+// did not report hashed are calculated again, the minimum hash among the others counts for the
+// client's request right away. the hash reported is verified but the count of nonces hashed can't
+// be: updateProgress only takes counts which grow and stay within the work unit, and the nonces
+// counted are spot checked like a result, so that a miner counting nonces it skipped is caught
+func requeueWork(minerId int, workU *workUnit) {
+	clientStatus := clients[workU.clientWorkFor]
+	if workU.cancelled {
+		return
+	}
+	if workU.hashed == 0 || clientStatus == nil || workU.check != nil {
+		jobQ.PushFront(workU)
+		return
+	}
+	data, lower, upper := workU.workMsg.Data, workU.workMsg.Lower, workU.workMsg.Upper
+	// the miner may have hashed past a truncated work unit
+	if workU.hashed > upper-lower {
+		finishWork(workU, workU.minHash, workU.nonce)
+		return
+	}
+	if betterResult(clientStatus.target, workU.minHash, workU.nonce, clientStatus.minHash, clientStatus.nonce) {
+		clientStatus.minHash = workU.minHash
+		clientStatus.nonce = workU.nonce
+	}
+	journalDone(clientStatus, lower, lower+workU.hashed-1, workU.minHash, workU.nonce)
+	if target := workU.workMsg.Target; target == 0 || workU.minHash >= target {
+		scheduleSpotCheck(minerId, workU, lower, lower+workU.hashed-1, workU.minHash, workU.nonce)
+	}
+	FLOG.Printf("requeue nonces %d to %d of %v\n", lower+workU.hashed, upper, workU.clientWorkFor)
+	jobQ.PushFront(&workUnit{
+		clientWorkFor: workU.clientWorkFor,
+		workMsg:       bitcoin.NewTargetRequest(data, lower+workU.hashed, upper, workU.workMsg.Target),
+	})
 }
 
 // update calculation result of a client's request, when receiving calculation result from a miner.
-// will send the final result back to client if all partitioned calculations for the client's request are done
 func updateResult(connId int, msg *bitcoin.Message) {
 	workU := minerCurrWork[connId]
+	if workU == nil {
+		return
+	}
+	// the result is recomputed, a miner returning a hash which is not the hash of its nonce is blacklisted
+	if !verifyResult(workU, msg) {
+		FLOG.Printf("wrong result of miner %d: %v\n", connId, msg)
+		blacklistMiner(connId)
+		return
+	}
+	// results carry the range hashed, which may go past a truncated work unit
+	covered := workU.workMsg.Upper
+	if msg.Upper >= msg.Lower && msg.Lower == workU.workMsg.Lower {
+		covered = msg.Upper
+	}
+	updateHashRate(connId, covered-workU.workMsg.Lower+1, workU.assignedAt)
 	// mark the miner as unoccupied
 	minerCurrWork[connId] = nil
 	unOccupiedMiner[connId] = true
+	if workU.cancelled {
+		return
+	}
+	if workU.check != nil {
+		checkSpotCheck(connId, workU, msg)
+	} else if target := workU.workMsg.Target; target == 0 || msg.Hash >= target {
+		// a hash below the target ends the request, there is nothing left to check
+		scheduleSpotCheck(connId, workU, workU.workMsg.Lower, covered, msg.Hash, msg.Nonce)
+	}
+	finishWork(workU, msg.Hash, msg.Nonce)
+}
+
+// update calculation result of a client's request with the result of a finished work unit.
+// will send the final result back to client if all partitioned calculations for the client's request are done.
+// in difficulty-target mode, the work units above the first nonce found with a hash below the target are
+// cancelled, so the result is sent as soon as the nonces below it are hashed
+func finishWork(workU *workUnit, hash, nonce uint64) {
 	clientStatus := clients[workU.clientWorkFor]
-	// if the client has already lost connection, just ignore its result message
-	if clientStatus != nil {
-		clientStatus.notFinishedJob -= 1
-		// update the calculation result on server
-		if msg.Hash < clientStatus.minHash {
-			clientStatus.minHash = msg.Hash
-			clientStatus.nonce = msg.Nonce
+	// if the client has already lost connection, or the work unit is not needed anymore, just ignore its result
+	if clientStatus == nil || workU.cancelled {
+		return
+	}
+	clientStatus.notFinishedJob -= 1
+	// update the calculation result on server
+	if betterResult(clientStatus.target, hash, nonce, clientStatus.minHash, clientStatus.nonce) {
+		clientStatus.minHash = hash
+		clientStatus.nonce = nonce
+		if clientStatus.target != 0 && hash < clientStatus.target {
+			cutRequest(workU.clientWorkFor, nonce)
+		}
+	}
+	journalDone(clientStatus, workU.workMsg.Lower, workU.workMsg.Upper, hash, nonce)
+	// if all partitioned jobs of the client's request are done, return the result back to the client
+	if clientStatus.allAssigned && clientStatus.notFinishedJob == 0 {
+		sendResult(workU.clientWorkFor)
+	}
+}
+
+// return whether the given hash of nonce is a better result for a request than the minimum hash
+// found so far. in difficulty-target mode, the first nonce with a hash below the target is better
+// than any other one below the target
+func betterResult(target, hash, nonce, minHash, minNonce uint64) bool {
+	if target != 0 && hash < target && minHash < target {
+		return nonce < minNonce
+	}
+	return hash < minHash
+}
+
+// a hash below the target of a client's request was found at nonce, so the nonces above it are not
+// needed anymore: those not handed out yet and the work units above it in the job queue are dropped,
+// and the miners hashing above it are told to stop. the work units are disjoint, so those below the
+// nonce go on until the first nonce with a hash below the target is known
+func cutRequest(key requestKey, nonce uint64) {
+	status := clients[key]
+	// the nonces not handed out yet are above all those handed out
+	status.allAssigned = true
+	for e := jobQ.Front(); e != nil; {
+		next := e.Next()
+		if workU := e.Value.(*workUnit); workU.clientWorkFor == key && workU.workMsg.Lower > nonce {
+			jobQ.Remove(e)
+			status.notFinishedJob -= 1
 		}
-		// if all partitioned jobs of the client's request are done, return the result back to the client
-		if clientStatus.notFinishedJob == 0 {
-			resultMsg := bitcoin.NewResult(clientStatus.minHash, clientStatus.nonce)
-			// if the connection of the client is lost, just ignore the result message
-			FLOG.Println("send back result: ", resultMsg.Hash, resultMsg.Nonce)
-			sendMessage(workU.clientWorkFor, resultMsg)
-			delete(clients, workU.clientWorkFor)
+		e = next
+	}
+	for minerId, workU := range minerCurrWork {
+		if workU != nil && workU.clientWorkFor == key && !workU.cancelled && workU.workMsg.Lower > nonce {
+			FLOG.Printf("cancel work of miner %d above nonce %d of %v\n", minerId, nonce, key)
+			sendMessage(minerId, bitcoin.NewCancel(workU.workMsg.Data, workU.workMsg.Lower))
+			workU.cancelled = true
+			status.notFinishedJob -= 1
 		}
 	}
 }
 
+// send the result of a client's request back to the client, and forget the request. a journaled
+// request stays in the journal if the result can't be sent, so that the client can get it later
+func sendResult(key requestKey) {
+	clientStatus := clients[key]
+	resultMsg := bitcoin.NewResult(clientStatus.minHash, clientStatus.nonce)
+	resultMsg.ID = clientStatus.id
+	// if the connection of the client is lost, just ignore the result message
+	FLOG.Println("send back result: ", resultMsg.Hash, resultMsg.Nonce)
+	err := sendMessage(key.connId, resultMsg)
+	if err == nil && clientStatus.id != 0 {
+		if err := requestJournal.logFinished(clientStatus.journaled); err != nil {
+			FLOG.Println("cannot journal result: ", err)
+		}
+	} else if clientStatus.id != 0 {
+		requestJournal.release(clientStatus.journaled)
+	}
+	delete(clients, key)
+}
+
+// record in the journal that the nonces from lower to upper of a client's request are hashed
+func journalDone(clientStatus *clientStatus, lower, upper, hash, nonce uint64) {
+	if clientStatus.id == 0 {
+		return
+	}
+	if err := requestJournal.logDone(clientStatus.journaled, lower, upper, hash, nonce); err != nil {
+		FLOG.Println("cannot journal work: ", err)
+	}
+}
+
 // handle income message from client and miner
 func handleIncomeMessage(connId int, payLoad []byte) {
 	// unmarshall the message
@@ -136,116 +545,253 @@ func handleIncomeMessage(connId int, payLoad []byte) {
 		fmt.Println("cannot unmarshall the message data")
 		return
 	}
+	if blacklisted[connId] {
+		return
+	}
 
 	FLOG.Println("handle income message: ", msg)
 	switch msg.Type {
 	case bitcoin.Join:
-		// register the joined miner
+		// register the joined miner, its first work unit is sized by the hash rate it reports
 		minerCurrWork[connId] = nil
 		unOccupiedMiner[connId] = true
+		if msg.HashRate > 0 {
+			minerHashRate[connId] = float64(msg.HashRate)
+		}
 	case bitcoin.Request:
-		// if client sends new request while the previous request has not finished, just ignore the new request
-		if clients[connId] == nil {
-			partitionJob(connId, msg)
+		// requests with different IDs are served concurrently. if client sends new request while the
+		// previous request with the same ID has not finished, just ignore the new request
+		key := requestKey{connId, msg.ID}
+		if clients[key] == nil {
+			scheduleRequest(key, msg)
+		}
+	case bitcoin.Cancel:
+		// a client gives up one of its requests, it is not resumed later
+		key := requestKey{connId, msg.ID}
+		if status := clients[key]; status != nil {
+			FLOG.Printf("%v cancelled\n", key)
+			if status.id != 0 {
+				if err := requestJournal.logFinished(status.journaled); err != nil {
+					FLOG.Println("cannot journal cancel: ", err)
+				}
+			}
+			dropRequest(key)
 		}
 	case bitcoin.Result:
 		updateResult(connId, msg)
+	case bitcoin.Progress:
+		updateProgress(connId, msg)
 	}
 }
 
-// assign pending jobs in job queue to unoccupied miners
+// assign pending jobs to unoccupied miners, stealing work from busy miners when there are none
 func assignJobsToUnoccupiedMiner() {
-	if jobQ.Len() > 0 {
-		for connId, _ := range unOccupiedMiner {
-
-			// choose the first work unit that works for a active client
-			for jobQ.Len() > 0 {
-				workU := jobQ.Front().Value.(*workUnit)
-				// if the client this work unit works for is active, assign it to unoccupied miner;
-				// otherwise remove it from job queue since we don't need to do any computation for a lost client
-				if clients[workU.clientWorkFor] != nil {
-					err := sendMessage(connId, workU.workMsg)
-					// if the job is assigned successfully
-					if err == nil {
-						jobQ.Remove(jobQ.Front())
-						minerCurrWork[connId] = workU
-						delete(unOccupiedMiner, connId)
-					}
-					break
-				} else {
-					jobQ.Remove(jobQ.Front())
-				}
-			}
-			if jobQ.Len() == 0 {
-				break
-			}
+	assigned := false
+	defer func() {
+		if assigned {
+			logQueueDepths()
+		}
+	}()
+	for connId, _ := range unOccupiedMiner {
+		if drained[connId] {
+			continue
+		}
+		workU := nextWorkUnit(connId)
+		if workU == nil {
+			workU = stealWork(connId)
+		}
+		// spot checks are not handed out to the miner whose result they check, so another miner may still get work
+		if workU == nil {
+			continue
+		}
+		workU.assignedAt = time.Now()
+		err := sendMessage(connId, workU.workMsg)
+		// if the job is assigned successfully
+		if err == nil {
+			minerCurrWork[connId] = workU
+			delete(unOccupiedMiner, connId)
+			assigned = true
+		} else {
+			jobQ.PushFront(workU)
 		}
 	}
 }
 
+// message read from the server or the admin server, or the error of a lost connection
+type incomingMessage struct {
+	server  lsp.Server
+	connId  int
+	payLoad []byte
+	err     error
+}
+
+// read the messages of a server and pass them on to the main loop, which handles the messages of
+// both servers one at a time
+func readMessages(server lsp.Server, incoming chan<- *incomingMessage) {
+	for {
+		connId, payLoad, err := server.Read()
+		incoming <- &incomingMessage{server, connId, payLoad, err}
+	}
+}
+
 // handle miner/client connection lost
 func handleFailure(connId int) {
+	delete(blacklisted, connId)
+	delete(drained, connId)
 	// if a miner losts connection
 	if currWork, ok := minerCurrWork[connId]; ok {
-		// put the work that the lost miner was doing back to the job queue (at front)
+		// put the rest of the work that the lost miner was doing back to the job queue (at front)
 		if currWork != nil {
-			jobQ.PushFront(currWork)
+			requeueWork(connId, currWork)
 		}
 		// delete this miner from unOccupiedMiner and minerCurrWork
 		delete(unOccupiedMiner, connId)
 		delete(minerCurrWork, connId)
-	} else if clients[connId] != nil {
-		// if a client losts connection
-		delete(clients, connId)
+		delete(minerHashRate, connId)
+	} else {
+		// if a client losts connection, all its requests are dropped. their journaled state can be
+		// resumed by the client on a new connection
+		for key, status := range clients {
+			if key.connId == connId {
+				if status.id != 0 {
+					requestJournal.release(status.journaled)
+				}
+				dropRequest(key)
+			}
+		}
+	}
+}
+
+// forget a lost or cancelled client request: its nonces not handed out yet and its work units in the job
+// queue are dropped, and the miners working for it are told to stop
+func dropRequest(key requestKey) {
+	delete(clients, key)
+	if requests := requestQ[key.connId]; requests != nil {
+		for e := requests.Front(); e != nil; e = e.Next() {
+			if e.Value.(requestKey) == key {
+				requests.Remove(e)
+				break
+			}
+		}
+		if requests.Len() == 0 {
+			delete(requestQ, key.connId)
+			for e := clientQ.Front(); e != nil; e = e.Next() {
+				if e.Value.(int) == key.connId {
+					clientQ.Remove(e)
+					break
+				}
+			}
+		}
+	}
+	for e := jobQ.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*workUnit).clientWorkFor == key {
+			jobQ.Remove(e)
+		}
+		e = next
+	}
+	cancelWork(key)
+}
+
+// tell the miners working for a lost or cancelled client request to stop. they stay occupied until they
+// report the partial result of the nonces hashed so far, which is then ignored
+func cancelWork(key requestKey) {
+	for minerId, workU := range minerCurrWork {
+		if workU != nil && workU.clientWorkFor == key && !workU.cancelled {
+			FLOG.Printf("cancel work of miner %d for %v\n", minerId, key)
+			sendMessage(minerId, bitcoin.NewCancel(workU.workMsg.Data, workU.workMsg.Lower))
+			workU.cancelled = true
+		}
 	}
 }
 
 func main() {
-	const numArgs = 2
+	const numArgs = 1
 	var port int
 
-	if len(os.Args) != numArgs {
-		fmt.Println("Usage: ./server <port>")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != numArgs && len(args) != numArgs+1 {
+		fmt.Println("Usage: ./server [-spotcheck <percent>] <port> [adminPort]")
+		return
+	}
+	if *spotCheckPercent < 0 || *spotCheckPercent > 100 {
+		fmt.Println("spot check percentage must be from 0 to 100")
 		return
 	}
 
-	port, err := strconv.Atoi(os.Args[1])
+	port, err := strconv.Atoi(args[0])
 
 	if err != nil {
 		fmt.Println("error parsing port")
 		return
 	}
 
+	// admin clients connect to the port after the server port, unless another one is given
+	adminPort := port + 1
+	if len(args) == numArgs+1 {
+		adminPort, err = strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Println("error parsing admin port")
+			return
+		}
+	}
+
 	params := lsp.NewParams()
 	lspServer, err = lsp.NewServer(port, params)
 	if err != nil {
 		fmt.Println("Cannot create the server")
 		return
 	}
+	adminServer, err = lsp.NewServerAddr("127.0.0.1:"+strconv.Itoa(adminPort), params)
+	if err != nil {
+		fmt.Println("Cannot create the admin server")
+		return
+	}
 
 	minerCurrWork = make(map[int]*workUnit)
 	unOccupiedMiner = make(map[int]bool)
-	clients = make(map[int]*clientStatus)
+	minerHashRate = make(map[int]float64)
+	blacklisted = make(map[int]bool)
+	drained = make(map[int]bool)
+	clients = make(map[requestKey]*clientStatus)
+	clientQ = list.New()
+	requestQ = make(map[int]*list.List)
 	jobQ = list.New()
+	requestJournal, err = openJournal(journalName)
+	if err != nil {
+		fmt.Println("Cannot open the journal: ", err)
+		return
+	}
 
 	// use logger to save logs into file
-	file, err := os.OpenFile(name, flag, perm)
+	file, err := os.OpenFile(name, logFlag, perm)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 	FLOG = log.New(file, "", log.Lshortfile|log.Lmicroseconds)
 
+	incoming := make(chan *incomingMessage)
+	go readMessages(lspServer, incoming)
+	go readMessages(adminServer, incoming)
 	for {
 		// assign pending jobs from the job queue to unoccupied miners
 		assignJobsToUnoccupiedMiner()
-		connId, payLoad, err := lspServer.Read()
+		in := <-incoming
+		if in.server == adminServer {
+			// a lost admin client leaves nothing behind
+			if in.err == nil {
+				handleAdminMessage(in.connId, in.payLoad)
+			}
+			continue
+		}
 		// if error occurs when reading, it indicates some connections from client/miner get lost
-		if err != nil {
-			FLOG.Println("handle failure: ", connId)
-			handleFailure(connId)
+		if in.err != nil {
+			FLOG.Println("handle failure: ", in.connId)
+			handleFailure(in.connId)
 		} else {
-			handleIncomeMessage(connId, payLoad)
+			handleIncomeMessage(in.connId, in.payLoad)
 		}
 	}
 }
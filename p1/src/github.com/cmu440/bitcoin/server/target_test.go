@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cmu440/bitcoin"
+)
+
+// a nonce from lower to upper whose hash is not below target, reported by a miner which found nothing
+func notFound(t *testing.T, data string, lower, upper, target uint64) uint64 {
+	for nonce := lower; nonce <= upper; nonce++ {
+		if bitcoin.Hash(data, nonce) >= target {
+			return nonce
+		}
+	}
+	t.Fatalf("Every nonce from %d to %d is below the target", lower, upper)
+	return 0
+}
+
+func TestTargetMode(t *testing.T) {
+	// miners 1 to 3 hash the first three work units, the first and third ones have a hash below the target
+	first, third := uint64(5000), uint64(25000)
+	target := bitcoin.Hash("hello", first)
+	if hash := bitcoin.Hash("hello", third); hash > target {
+		target = hash
+	}
+	target += 1
+	for _, test := range []struct {
+		name      string
+		found     map[int]bool // miners reporting a hash below the target
+		order     []int        // miners reporting their result, the result is sent after the last one
+		nonce     uint64
+		cancelled []int
+	}{
+		{"later chunk finds first", map[int]bool{1: true, 3: true}, []int{3, 1}, first, []int{2}},
+		{"earlier chunks find nothing", map[int]bool{3: true}, []int{3, 2, 1}, third, nil},
+		{"lowest chunk finds first", map[int]bool{1: true, 3: true}, []int{1}, first, []int{2, 3}},
+	} {
+		srv := resetState(t)
+		for minerId := 1; minerId <= 4; minerId++ {
+			addMiner(minerId, 0)
+		}
+		key := requestKey{6, 0}
+		scheduleRequest(key, bitcoin.NewTargetRequest("hello", 0, 99999, target))
+		units := make(map[int]*workUnit)
+		for minerId := 1; minerId <= 4; minerId++ {
+			units[minerId] = startWork(t, minerId)
+		}
+		// the work unit of a lost miner waits in the job queue
+		handleFailure(4)
+
+		for _, minerId := range test.order {
+			if msgs := srv.written[key.connId]; len(msgs) != 0 {
+				t.Fatalf("%s: result sent before miner %d reported", test.name, minerId)
+			}
+			lower, upper := units[minerId].workMsg.Lower, units[minerId].workMsg.Upper
+			nonce := notFound(t, "hello", lower, upper, target)
+			if test.found[minerId] {
+				nonce = map[int]uint64{1: first, 3: third}[minerId]
+				upper = nonce
+			}
+			receive(minerId, resultOf("hello", lower, upper, nonce))
+		}
+		msgs := srv.written[key.connId]
+		if len(msgs) != 1 || msgs[0].Type != bitcoin.Result || msgs[0].Nonce != test.nonce {
+			t.Fatalf("%s: client got %v, expected the result of nonce %d", test.name, msgs, test.nonce)
+		}
+		if jobQ.Len() != 0 {
+			t.Fatalf("%s: work unit %s left in the job queue", test.name, describe(jobQ.Front().Value.(*workUnit)))
+		}
+		var cancelled []int
+		for minerId, msgs := range srv.written {
+			if minerId != key.connId && len(msgs) == 1 && msgs[0].Type == bitcoin.Cancel && msgs[0].Lower == units[minerId].workMsg.Lower {
+				cancelled = append(cancelled, minerId)
+			} else if minerId != key.connId {
+				t.Fatalf("%s: miner %d got %v", test.name, minerId, msgs)
+			}
+		}
+		sort.Ints(cancelled)
+		if !reflect.DeepEqual(cancelled, test.cancelled) {
+			t.Fatalf("%s: work units of miners %v cancelled, expected %v", test.name, cancelled, test.cancelled)
+		}
+		// the cancelled miners report the nonces hashed so far, which changes nothing
+		for _, minerId := range cancelled {
+			lower := units[minerId].workMsg.Lower
+			receive(minerId, resultOf("hello", lower, lower+10, notFound(t, "hello", lower, lower+10, target)))
+			if minerCurrWork[minerId] != nil || !unOccupiedMiner[minerId] {
+				t.Fatalf("%s: miner %d not free after reporting its cancelled work unit", test.name, minerId)
+			}
+		}
+		if len(srv.written[key.connId]) != 1 || jobQ.Len() != 0 {
+			t.Fatalf("%s: cancelled work units counted for the request", test.name)
+		}
+	}
+}
+
+func TestTargetModeResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	j := mustOpenJournal(t, path)
+	msg := bitcoin.NewTargetRequest("hello", 0, 99999, 500)
+	msg.ID = 7
+	key, _ := j.logRequest(1, msg)
+	// a hash below the target was found in the third work unit while the second was in progress
+	j.logDone(key, 0, 9999, 800, 42)
+	j.logDone(key, 20000, 25000, 300, 25000)
+	j.file.Close()
+
+	resetState(t)
+	useJournal(t, path)
+	addMiner(9, 0)
+	scheduleRequest(requestKey{1, 7}, msg)
+	status := clients[requestKey{1, 7}]
+	if status == nil || status.nonce != 25000 {
+		t.Fatalf("Journaled request %v not resumed with the nonce found", key)
+	}
+	// only the gap below the nonce found is hashed, the rest of the range is not needed
+	if workU := nextWorkUnit(9); workU == nil || workU.workMsg.Lower != 10000 || workU.workMsg.Upper != 19999 {
+		t.Fatalf("Work unit is %s, expected nonces 10000 to 19999", describe(workU))
+	}
+	if workU := nextWorkUnit(9); workU != nil {
+		t.Fatalf("Work unit %s handed out above the nonce found", describe(workU))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"github.com/cmu440/bitcoin"
+	"math/rand"
+)
+
+var spotCheckPercent = flag.Int("spotcheck", 10, "percentage of the work units whose result is spot checked by another miner, 0 to disable")
+
+// spot check of the result of a miner. another miner hashes the same nonces again, and must find
+// the same minimum hash
+type spotCheck struct {
+	minerId int    // miner whose result is checked
+	minHash uint64 // minimum hash the miner reported
+	nonce   uint64 // nonce of the minimum hash
+}
+
+// miners caught returning wrong results. their connections are closed, and the messages they sent
+// before are ignored
+var blacklisted map[int]bool
+
+// check that a result or progress message of a miner covers nonces of its work unit, and that the
+// hash it reports is the hash of its nonce
+func verifyResult(workU *workUnit, msg *bitcoin.Message) bool {
+	lower, upper := workU.workMsg.Lower, workU.workMsg.Upper
+	// results carry the range hashed, which may go past a truncated work unit
+	if msg.Upper >= msg.Lower && msg.Lower == lower {
+		upper = msg.Upper
+	}
+	if msg.Nonce < lower || msg.Nonce > upper {
+		return false
+	}
+	return bitcoin.Hash(workU.workMsg.Data, msg.Nonce) == msg.Hash
+}
+
+// randomly pick a sample of the work units, and queue the nonces from lower to upper a miner hashed
+// with the given result to be hashed again by another miner. the result of the client's request
+// waits for its spot checks
+func scheduleSpotCheck(minerId int, workU *workUnit, lower, upper, minHash, nonce uint64) {
+	clientStatus := clients[workU.clientWorkFor]
+	if clientStatus == nil || rand.Intn(100) >= *spotCheckPercent || activeMiners() < 2 {
+		return
+	}
+	clientStatus.notFinishedJob += 1
+	FLOG.Printf("spot check nonces %d to %d of miner %d\n", lower, upper, minerId)
+	jobQ.PushBack(&workUnit{
+		clientWorkFor: workU.clientWorkFor,
+		workMsg:       bitcoin.NewRequest(workU.workMsg.Data, lower, upper),
+		check:         &spotCheck{minerId: minerId, minHash: minHash, nonce: nonce},
+	})
+}
+
+// compare the result of a spot check with the result of the checked miner. both hashes are verified,
+// so the miner which reported the larger minimum hash skipped nonces and is blacklisted
+func checkSpotCheck(checkerId int, workU *workUnit, msg *bitcoin.Message) {
+	check := workU.check
+	// a cancelled spot check proves nothing
+	if msg.Upper < workU.workMsg.Upper || msg.Hash == check.minHash {
+		return
+	}
+	FLOG.Printf("spot check of miner %d by miner %d failed: hash %d of nonce %d, expected %d of nonce %d\n",
+		check.minerId, checkerId, msg.Hash, msg.Nonce, check.minHash, check.nonce)
+	if msg.Hash > check.minHash {
+		blacklistMiner(checkerId)
+	} else {
+		blacklistMiner(check.minerId)
+	}
+}
+
+// blacklist a miner and close its connection. its current work unit goes back to the job queue
+// as a whole, whatever progress it reported
+func blacklistMiner(minerId int) {
+	currWork, ok := minerCurrWork[minerId]
+	if !ok {
+		return
+	}
+	FLOG.Printf("blacklist miner %d\n", minerId)
+	blacklisted[minerId] = true
+	if currWork != nil && !currWork.cancelled {
+		currWork.hashed = 0
+		jobQ.PushFront(currWork)
+	}
+	delete(unOccupiedMiner, minerId)
+	delete(minerCurrWork, minerId)
+	delete(minerHashRate, minerId)
+	lspServer.CloseConn(minerId)
+}
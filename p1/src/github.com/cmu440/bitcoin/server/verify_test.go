@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/cmu440/bitcoin"
+)
+
+// result message of a miner which hashed the nonces from lower to upper, reporting the given nonce
+func resultOf(data string, lower, upper, nonce uint64) *bitcoin.Message {
+	return &bitcoin.Message{Type: bitcoin.Result, Data: data, Lower: lower, Upper: upper,
+		Hash: bitcoin.Hash(data, nonce), Nonce: nonce}
+}
+
+// nonce with the minimum hash from lower to upper, and the one with the next larger hash
+func minNonces(data string, lower, upper uint64) (uint64, uint64) {
+	best, second := lower, lower+1
+	if bitcoin.Hash(data, second) < bitcoin.Hash(data, best) {
+		best, second = second, best
+	}
+	for nonce := lower + 2; nonce <= upper; nonce++ {
+		if hash := bitcoin.Hash(data, nonce); hash < bitcoin.Hash(data, best) {
+			best, second = nonce, best
+		} else if hash < bitcoin.Hash(data, second) {
+			second = nonce
+		}
+	}
+	return best, second
+}
+
+func TestVerifyResult(t *testing.T) {
+	wrong := resultOf("hello", 100, 199, 150)
+	wrong.Hash += 1
+	for _, test := range []struct {
+		name     string
+		upper    uint64 // upper end of the work unit, after a truncate
+		msg      *bitcoin.Message
+		verified bool
+	}{
+		{"result", 199, resultOf("hello", 100, 199, 150), true},
+		{"bounds", 199, resultOf("hello", 100, 199, 199), true},
+		{"progress", 199, resultOf("hello", 100, 120, 110), true},
+		{"wrong hash", 199, wrong, false},
+		{"nonce below the range", 199, resultOf("hello", 100, 199, 99), false},
+		{"nonce above the range", 199, resultOf("hello", 100, 199, 200), false},
+		{"nonce above the progress", 199, resultOf("hello", 100, 120, 121), false},
+		// the miner got the truncate after hashing past it
+		{"truncated", 149, resultOf("hello", 100, 199, 180), true},
+		{"truncated from another lower", 149, resultOf("hello", 50, 199, 180), false},
+		{"empty range", 149, resultOf("hello", 100, 99, 120), true},
+	} {
+		workU := &workUnit{workMsg: bitcoin.NewRequest("hello", 100, test.upper)}
+		if verified := verifyResult(workU, test.msg); verified != test.verified {
+			t.Errorf("%s: verified %v, expected %v", test.name, verified, test.verified)
+		}
+	}
+}
+
+func TestWrongResultBlacklists(t *testing.T) {
+	srv := resetState(t)
+	addMiner(1, 0)
+	key := requestKey{3, 0}
+	scheduleRequest(key, bitcoin.NewRequest("hello", 0, 99))
+	workU := assignWork(1, key, 0, 99, 50)
+	msg := resultOf("hello", 0, 99, 42)
+	msg.Hash = 0
+
+	updateResult(1, msg)
+	if !blacklisted[1] || !srv.closed[1] {
+		t.Fatalf("Miner 1 returning a wrong hash not blacklisted")
+	}
+	if _, ok := minerCurrWork[1]; ok {
+		t.Fatalf("Blacklisted miner 1 still gets work units")
+	}
+	// the whole work unit is hashed again, whatever progress the miner reported
+	if jobQ.Front() == nil || jobQ.Front().Value.(*workUnit) != workU || workU.hashed != 0 {
+		t.Fatalf("Work unit of miner 1 not requeued as a whole")
+	}
+	if status := clients[key]; status.minHash != math.MaxUint64 {
+		t.Fatalf("Wrong hash %d of miner 1 counted for the request", status.minHash)
+	}
+}
+
+func TestSpotCheck(t *testing.T) {
+	best, second := minNonces("hello", 0, 999)
+	bestOfHalf, _ := minNonces("hello", 0, 499)
+	for _, test := range []struct {
+		name        string
+		reported    uint64           // nonce the checked miner reported
+		msg         *bitcoin.Message // result of the checker
+		blacklisted int              // 0 if no miner is blacklisted
+	}{
+		{"agree", best, resultOf("hello", 0, 999, best), 0},
+		{"checked miner skipped nonces", second, resultOf("hello", 0, 999, best), 1},
+		{"checker skipped nonces", best, resultOf("hello", 0, 999, second), 2},
+		{"cancelled", second, resultOf("hello", 0, 499, bestOfHalf), 0},
+	} {
+		srv := resetState(t)
+		addMiner(1, 0)
+		addMiner(2, 0)
+		key := requestKey{3, 0}
+		scheduleRequest(key, bitcoin.NewRequest("hello", 0, 999))
+		clients[key].allAssigned = true
+		check := assignWork(2, key, 0, 999, 0)
+		check.check = &spotCheck{minerId: 1, minHash: bitcoin.Hash("hello", test.reported), nonce: test.reported}
+
+		updateResult(2, test.msg)
+		for minerId := 1; minerId <= 2; minerId++ {
+			expected := minerId == test.blacklisted
+			if blacklisted[minerId] != expected || srv.closed[minerId] != expected {
+				t.Errorf("%s: miner %d blacklisted %v, expected %v", test.name, minerId, blacklisted[minerId], expected)
+			}
+		}
+		// the request was only waiting for the spot check, its result is sent whatever the outcome
+		if msgs := srv.written[key.connId]; len(msgs) != 1 || msgs[0].Type != bitcoin.Result {
+			t.Errorf("%s: client got %v, expected its result", test.name, msgs)
+		}
+	}
+}
+
+func TestSpotCheckPercent(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		percent  int
+		progress bool // the miner is lost after reporting progress, instead of reporting its result
+		checked  []nonceRange
+	}{
+		{"disabled", 0, false, nil},
+		{"result", 100, false, []nonceRange{{0, 9999}}},
+		{"progress", 100, true, []nonceRange{{0, 4999}}},
+		{"progress disabled", 0, true, nil},
+	} {
+		resetState(t)
+		*spotCheckPercent = test.percent
+		addMiner(1, 0)
+		addMiner(2, 0)
+		key := requestKey{3, 0}
+		scheduleRequest(key, bitcoin.NewRequest("hello", 0, 99999))
+		assignWork(1, key, 0, 9999, 0)
+		if test.progress {
+			updateProgress(1, progressOf("hello", 0, 4999, 42))
+			handleFailure(1)
+		} else {
+			updateResult(1, resultOf("hello", 0, 9999, 42))
+		}
+
+		var checked []nonceRange
+		for e := jobQ.Front(); e != nil; e = e.Next() {
+			if workU := e.Value.(*workUnit); workU.check != nil {
+				if workU.check.minerId != 1 || workU.check.nonce != 42 {
+					t.Errorf("%s: spot check of miner %d at nonce %d, expected miner 1 at nonce 42",
+						test.name, workU.check.minerId, workU.check.nonce)
+				}
+				checked = append(checked, nonceRange{workU.workMsg.Lower, workU.workMsg.Upper})
+			}
+		}
+		if !reflect.DeepEqual(checked, test.checked) {
+			t.Errorf("%s: spot checked %v, expected %v", test.name, checked, test.checked)
+		}
+	}
+}
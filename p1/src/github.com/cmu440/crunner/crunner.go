@@ -22,6 +22,7 @@ var (
 	epochMillis = flag.Int("ems", lsp.DefaultEpochMillis, "epoch duration (ms)")
 	windowSize  = flag.Int("wsize", lsp.DefaultWindowSize, "window size")
 	showLogs    = flag.Bool("v", false, "show crunner logs")
+	captureFile = flag.String("capture", "", "record the datagrams sent and received to this file")
 )
 
 func init() {
@@ -36,6 +37,13 @@ func main() {
 	}
 	lspnet.SetClientReadDropPercent(*readDrop)
 	lspnet.SetClientWriteDropPercent(*writeDrop)
+	if *captureFile != "" {
+		if err := lspnet.StartCaptureFile(*captureFile); err != nil {
+			fmt.Printf("Failed to start capture to %s: %s\n", *captureFile, err)
+			return
+		}
+		defer lspnet.StopCapture()
+	}
 	params := &lsp.Params{
 		EpochLimit:  *epochLimit,
 		EpochMillis: *epochMillis,
@@ -1,103 +1,133 @@
 // Constains implementation of a sequential buffer, which is designed specially for Message struct as its element
 // the Message elements in the buffer will be kept in increasing order acoording to their seq num
+// the buffer is a ring of slots indexed by seq num, so inserting, deleting or looking up a message by its seq num
+// takes constant time, and the ring grows (doubles) when the range of seq nums in the buffer doesn't fit in it
 // @author: Chun Chen
 
 package lsp
 
-import (
-	"container/list"
-)
+// initial number of slots in the ring, must be a power of 2
+const initialBufferCapacity = 16
 
 type buffer struct {
-	l *list.List
+	slots []*Message // slot of a message is its seq num masked by len(slots)-1, nil for empty slots
+	head  int        // smallest seq num in the buffer
+	tail  int        // largest seq num in the buffer + 1
+	count int        // number of messages in the buffer
 }
 
 func NewBuffer() *buffer {
-	return &buffer{list.New()}
+	return &buffer{slots: make([]*Message, initialBufferCapacity)}
 }
 
-// insert a message into the buffer, the function will guarantee the order of messages in the buffer
-func (buf *buffer) Insert(val *Message) {
-	l := buf.l
-	if l.Len() == 0 || val.SeqNum > l.Back().Value.(*Message).SeqNum {
-		l.PushBack(val)
-	} else {
-		insertSeqNumber := val.SeqNum
-		var insertBeforeEle *list.Element
-		insertBeforeEle = nil
-		for e := l.Front(); e != nil; e = e.Next() {
-			eleSeqNum := e.Value.(*Message).SeqNum
-			if insertSeqNumber <= eleSeqNum {
-				insertBeforeEle = e
-				break
-			}
-		}
+// return the slot which the message with given seq num goes to
+func (buf *buffer) slot(seqNum int) int {
+	return seqNum & (len(buf.slots) - 1)
+}
 
-		if insertSeqNumber < insertBeforeEle.Value.(*Message).SeqNum {
-			l.InsertBefore(val, insertBeforeEle)
-		}
+// grow the ring so that seq nums in [head, tail) fit in it, keeping all messages in the buffer
+func (buf *buffer) grow(head, tail int) {
+	capacity := len(buf.slots)
+	for tail-head > capacity {
+		capacity *= 2
+	}
+	if capacity == len(buf.slots) {
+		return
+	}
+	slots := make([]*Message, capacity)
+	for seqNum := buf.head; seqNum < buf.tail; seqNum++ {
+		slots[seqNum&(capacity-1)] = buf.slots[buf.slot(seqNum)]
 	}
+	buf.slots = slots
+}
+
+// insert a message into the buffer, the function will guarantee the order of messages in the buffer
+// return false if a message with the same seq num is already in the buffer
+func (buf *buffer) Insert(val *Message) bool {
+	seqNum := val.SeqNum
+	if buf.count == 0 {
+		buf.head = seqNum
+		buf.tail = seqNum + 1
+	} else if seqNum < buf.head {
+		buf.grow(seqNum, buf.tail)
+		buf.head = seqNum
+	} else if seqNum >= buf.tail {
+		buf.grow(buf.head, seqNum+1)
+		buf.tail = seqNum + 1
+	} else if buf.slots[buf.slot(seqNum)] != nil {
+		return false
+	}
+	buf.slots[buf.slot(seqNum)] = val
+	buf.count += 1
+	return true
 }
 
 // remove the first message in the buffer
 func (buf *buffer) Remove() *Message {
-	l := buf.l
-	retVal := l.Front().Value
-	l.Remove(l.Front())
-	return retVal.(*Message)
+	retVal := buf.Front()
+	buf.Delete(buf.head)
+	return retVal
 }
 
 // return the first message in the buffer
 func (buf *buffer) Front() *Message {
-	l := buf.l
-	return l.Front().Value.(*Message)
+	return buf.slots[buf.slot(buf.head)]
 }
 
 // delete message with specified seq num in the buffer
 // return true if message with specified seq num exists in the buffer
 func (buf *buffer) Delete(delSeqNum int) bool {
-	l := buf.l
-	for e := l.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Message).SeqNum == delSeqNum {
-			l.Remove(e)
-			return true
+	if delSeqNum < buf.head || delSeqNum >= buf.tail || buf.slots[buf.slot(delSeqNum)] == nil {
+		return false
+	}
+	buf.slots[buf.slot(delSeqNum)] = nil
+	buf.count -= 1
+
+	// keep head and tail pointing to messages in the buffer, skipping over the gaps
+	if buf.count == 0 {
+		buf.head = buf.tail
+		return true
+	}
+	if delSeqNum == buf.head {
+		for buf.slots[buf.slot(buf.head)] == nil {
+			buf.head += 1
+		}
+	}
+	if delSeqNum == buf.tail-1 {
+		for buf.slots[buf.slot(buf.tail-1)] == nil {
+			buf.tail -= 1
 		}
 	}
-	return false
+	return true
+}
+
+// return true if message with specified seq num exists in the buffer
+func (buf *buffer) Contains(seqNum int) bool {
+	return seqNum >= buf.head && seqNum < buf.tail && buf.slots[buf.slot(seqNum)] != nil
 }
 
 // adjust the buffer with specified window size
 // this function will remove all messages whose seq num is smaller than $seq num of last message in buffer$ - $window size$
 // this function is useful for latestAckBuffer
 func (buf *buffer) AdjustUsingWindow(windowSize int) {
-	l := buf.l
-	wRightBoundary := l.Back().Value.(*Message).SeqNum
-	wLeftBoundary := wRightBoundary - windowSize + 1
-	e := l.Front()
-	for e != nil {
-		nextE := e.Next()
-		if e.Value.(*Message).SeqNum < wLeftBoundary {
-			l.Remove(e)
-		} else {
-			break
-		}
-		e = nextE
+	wLeftBoundary := buf.tail - windowSize
+	for buf.count > 0 && buf.head < wLeftBoundary {
+		buf.Delete(buf.head)
 	}
 }
 
 // return all messages in the buffer to a slice
 func (buf *buffer) ReturnAll() []*Message {
-	l := buf.l
-	retVal := make([]*Message, l.Len())
-	pos := 0
-	for e := l.Front(); e != nil; e = e.Next() {
-		retVal[pos] = e.Value.(*Message)
-		pos += 1
+	retVal := make([]*Message, 0, buf.count)
+	for seqNum := buf.head; seqNum < buf.tail; seqNum++ {
+		if msg := buf.slots[buf.slot(seqNum)]; msg != nil {
+			retVal = append(retVal, msg)
+		}
 	}
 	return retVal
 }
 
 // return number of messages in the buffer
 func (buf *buffer) Len() int {
-	return buf.l.Len()
+	return buf.count
 }
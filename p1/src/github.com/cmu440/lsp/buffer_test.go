@@ -0,0 +1,157 @@
+// Buffer tests and benchmarks.
+
+// The tests check that the ring buffer keeps messages ordered by seq num,
+// rejects duplicates and grows past its initial capacity. The benchmarks
+// measure the buffer alone under a sliding window of acks, and the whole
+// LSP stack streaming messages from many clients with large window sizes.
+
+package lsp
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/cmu440/lspnet"
+)
+
+func checkBufferSeqNums(t *testing.T, buf *buffer, expected ...int) {
+	msgs := buf.ReturnAll()
+	if len(msgs) != len(expected) || buf.Len() != len(expected) {
+		t.Fatalf("Buffer has %d (Len %d) messages, expected %v", len(msgs), buf.Len(), expected)
+	}
+	for i, msg := range msgs {
+		if msg.SeqNum != expected[i] {
+			t.Fatalf("Buffer message %d has seq num %d, expected %v", i, msg.SeqNum, expected)
+		}
+	}
+	if len(expected) > 0 && buf.Front().SeqNum != expected[0] {
+		t.Fatalf("Buffer front has seq num %d, expected %d", buf.Front().SeqNum, expected[0])
+	}
+}
+
+func TestBufferOrder(t *testing.T) {
+	buf := NewBuffer()
+	for _, seqNum := range []int{5, 3, 9, 4, 7} {
+		if !buf.Insert(NewData(1, seqNum, nil)) {
+			t.Fatalf("Insert of seq num %d failed", seqNum)
+		}
+	}
+	if buf.Insert(NewData(1, 4, nil)) {
+		t.Fatalf("Duplicate insert of seq num 4 succeeded")
+	}
+	checkBufferSeqNums(t, buf, 3, 4, 5, 7, 9)
+
+	if buf.Delete(6) {
+		t.Fatalf("Delete of missing seq num 6 succeeded")
+	}
+	if !buf.Delete(9) || !buf.Delete(3) {
+		t.Fatalf("Delete of seq nums 9 and 3 failed")
+	}
+	checkBufferSeqNums(t, buf, 4, 5, 7)
+
+	if msg := buf.Remove(); msg.SeqNum != 4 {
+		t.Fatalf("Remove returned seq num %d, expected 4", msg.SeqNum)
+	}
+	checkBufferSeqNums(t, buf, 5, 7)
+}
+
+func TestBufferGrow(t *testing.T) {
+	buf := NewBuffer()
+	const numMsgs = 10 * initialBufferCapacity
+	for i := numMsgs; i > 0; i -= 2 {
+		buf.Insert(NewData(1, i, nil))
+	}
+	for i := 1; i < numMsgs; i += 2 {
+		buf.Insert(NewData(1, i, nil))
+	}
+	expected := make([]int, numMsgs)
+	for i := range expected {
+		expected[i] = i + 1
+	}
+	checkBufferSeqNums(t, buf, expected...)
+}
+
+func TestBufferAdjustUsingWindow(t *testing.T) {
+	buf := NewBuffer()
+	for i := 1; i <= 10; i++ {
+		buf.Insert(NewAck(1, i))
+		buf.AdjustUsingWindow(3)
+	}
+	checkBufferSeqNums(t, buf, 8, 9, 10)
+
+	buf.Delete(9)
+	buf.Insert(NewAck(1, 12))
+	buf.AdjustUsingWindow(3)
+	checkBufferSeqNums(t, buf, 10, 12)
+}
+
+// benchmarkBufferWindow fills a window of windowSize messages, then repeatedly acks
+// a random message in the window and slides the window forward like a sender does.
+func benchmarkBufferWindow(b *testing.B, windowSize int) {
+	unAcked, write := NewBuffer(), NewBuffer()
+	seqNum := 0
+	for ; seqNum < windowSize; seqNum++ {
+		unAcked.Insert(NewData(1, seqNum+1, nil))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		seqNum++
+		write.Insert(NewData(1, seqNum, nil))
+		unAcked.Delete(unAcked.Front().SeqNum + rand.Intn(unAcked.Len()))
+		if unAcked.Len() == 0 {
+			unAcked.Insert(write.Remove())
+		}
+		for write.Len() > 0 && write.Front().SeqNum-windowSize < unAcked.Front().SeqNum {
+			unAcked.Insert(write.Remove())
+		}
+	}
+}
+
+func BenchmarkBufferWindow1(b *testing.B)    { benchmarkBufferWindow(b, 1) }
+func BenchmarkBufferWindow64(b *testing.B)   { benchmarkBufferWindow(b, 64) }
+func BenchmarkBufferWindow1024(b *testing.B) { benchmarkBufferWindow(b, 1024) }
+
+// benchmarkThroughput streams b.N messages in total from numClients clients to the server.
+func benchmarkThroughput(b *testing.B, numClients, windowSize int) {
+	params := &Params{EpochLimit: 20, EpochMillis: 50, WindowSize: windowSize}
+	var srv Server
+	var err error
+	var port int
+	for i := 0; i < 5 && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		srv, err = NewServer(port, params)
+	}
+	if err != nil {
+		b.Fatalf("Failed to start server: %s", err)
+	}
+	defer srv.Close()
+
+	clients := make([]Client, numClients)
+	for i := range clients {
+		clients[i], err = NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), params)
+		if err != nil {
+			b.Fatalf("Failed to create client: %s", err)
+		}
+		defer clients[i].Close()
+	}
+
+	payload := []byte(fmt.Sprintf("%064d", 0))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clients[i%numClients].Write(payload)
+	}
+	for i := 0; i < b.N; i++ {
+		if _, _, err := srv.Read(); err != nil {
+			b.Fatalf("Server read failed: %s", err)
+		}
+	}
+}
+
+func BenchmarkThroughput1Client1Window(b *testing.B)      { benchmarkThroughput(b, 1, 1) }
+func BenchmarkThroughput1Client256Window(b *testing.B)    { benchmarkThroughput(b, 1, 256) }
+func BenchmarkThroughput100Clients1Window(b *testing.B)   { benchmarkThroughput(b, 100, 1) }
+func BenchmarkThroughput100Clients256Window(b *testing.B) { benchmarkThroughput(b, 100, 256) }
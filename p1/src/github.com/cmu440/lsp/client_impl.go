@@ -6,6 +6,7 @@ package lsp
 import (
 	"container/list"
 	"errors"
+	"io"
 )
 
 type client struct {
@@ -15,19 +16,24 @@ type client struct {
 	closeSignal           chan struct{}
 	connLostSignal        chan struct{}
 	connEstablishedSignal chan struct{}
-	writeBuffer           *buffer
+	writeBuffer           *writeQueue
 	unAckedMsgBuffer      *buffer
 	latestAckBuffer       *buffer
 	readBuffer            *buffer
+	datagramBuffer        *list.List
 	deferedRead           *list.List
 	deferedClose          *list.List
+	stats                 *ConnStats
 	connId                int
+	credential            uint64
 	seqNum                int
 	expectedSeqNum        int
+	receivedSeqNum        int
 	currEpoch             int
 	latestActiveEpoch     int
 	clientRunning         bool
 	connLost              bool
+	writeClosed           bool
 }
 
 // NewClient creates, initiates, and returns a new client. This function
@@ -47,27 +53,32 @@ func NewClient(hostport string, params *Params) (Client, error) {
 		closeSignal:           make(chan struct{}),
 		connLostSignal:        make(chan struct{}, 1),
 		connEstablishedSignal: make(chan struct{}, 1),
-		writeBuffer:           NewBuffer(),
+		writeBuffer:           newWriteQueue(),
 		unAckedMsgBuffer:      NewBuffer(),
 		latestAckBuffer:       NewBuffer(),
 		readBuffer:            NewBuffer(),
+		datagramBuffer:        list.New(),
 		deferedRead:           list.New(),
 		deferedClose:          list.New(),
+		stats:                 &ConnStats{},
 		connId:                0,
+		credential:            0,
 		seqNum:                0,
 		expectedSeqNum:        1,
+		receivedSeqNum:        1,
 		currEpoch:             0,
 		latestActiveEpoch:     0,
 		clientRunning:         true,
 		connLost:              false,
+		writeClosed:           false,
 	}
-	c.networkUtility = NewNetworkUtility(c.requestc)
+	c.networkUtility = NewNetworkUtility(c.deliverPacket)
 	err := c.networkUtility.dial(hostport)
 	if err != nil {
 		return nil, err
 	}
 	go c.eventHandler()
-	go c.networkUtility.networkHandler()
+	c.networkUtility.start()
 	go epochTimer(c.requestc, c.closeSignal, c.params.EpochMillis)
 
 	err = c.connect()
@@ -100,10 +111,32 @@ func (c *client) Read() ([]byte, error) {
 }
 
 func (c *client) Write(payload []byte) error {
-	_, err := c.doRequest(dowrite, payload)
+	return c.WriteWithPriority(payload, PriorityNormal)
+}
+
+func (c *client) WriteWithPriority(payload []byte, priority Priority) error {
+	if !validPriority(priority) {
+		return errors.New("invalid priority")
+	}
+	_, err := c.doRequest(dowrite, &priorityPayloadBundle{0, payload, priority})
+	return err
+}
+
+func (c *client) WriteUnreliable(payload []byte) error {
+	_, err := c.doRequest(dowriteunreliable, payload)
 	return err
 }
 
+func (c *client) CloseWrite() error {
+	_, err := c.doRequest(doclosewrite, nil)
+	return err
+}
+
+func (c *client) Stats() *ConnStats {
+	ret, _ := c.doRequest(dostats, nil)
+	return ret.(*ConnStats)
+}
+
 func (c *client) Close() error {
 	_, err := c.doRequest(doclose, nil)
 	return err
@@ -114,6 +147,11 @@ func (c *client) connect() error {
 	return err
 }
 
+// pass a packet received by network handler to the event handler
+func (c *client) deliverPacket(req *request) {
+	c.requestc <- req
+}
+
 // submit the request to reqeust channel (requestc). waiting for the event handler to handle
 func (c *client) doRequest(op int, val interface{}) (interface{}, error) {
 	req := &request{op, val, make(chan *retType)}
@@ -129,17 +167,30 @@ func (c *client) handleRead(req *request) {
 		req.replyc <- &retType{nil, errors.New("client closed")}
 		return
 	}
+	// if the expected message is not ready or is the end of stream, return a pending datagram if there is any
+	if (!c.readReady() || c.readBuffer.Front().Type == MsgFin) && c.datagramBuffer.Len() > 0 {
+		payload := c.datagramBuffer.Remove(c.datagramBuffer.Front()).([]byte)
+		req.replyc <- &retType{payload, nil}
+		return
+	}
 	// if connection is lost and there is nothing to read in the read buffer, return an error
-	if c.readBuffer.Len() == 0 || c.readBuffer.Front().SeqNum != c.expectedSeqNum {
+	if !c.readReady() {
 		req.replyc <- &retType{nil, errors.New("connection lost")}
 		return
 	}
 
+	// if the server has ended its stream and all messages before are read, return EOF.
+	// the end of stream message is kept in the read buffer, so further reads return EOF as well
+	if c.readBuffer.Front().Type == MsgFin {
+		req.replyc <- &retType{nil, io.EOF}
+		return
+	}
+
 	// return the expected message in the read buffer
-	readMsg := c.readBuffer.Front()
-	c.readBuffer.Remove()
+	readMsg := c.readBuffer.Remove()
 	c.expectedSeqNum += 1
 	req.replyc <- &retType{readMsg.Payload, nil}
+	releaseMessage(readMsg)
 }
 
 // handle user write request
@@ -154,25 +205,82 @@ func (c *client) handleWrite(req *request) {
 		req.replyc <- &retType{nil, errors.New("client closed")}
 		return
 	}
+	if c.writeClosed {
+		req.replyc <- &retType{nil, errors.New("write side closed")}
+		return
+	}
 
-	// if there is space in unAckedMsgBuffer, insert the message into the buffer and send it out via network
-	// otherwise insert it into write buffer
-	payload := req.val.([]byte)
-	c.seqNum += 1
-	sentMsg := NewData(c.connId, c.seqNum, payload)
-	windowSize := c.params.WindowSize
-	if c.writeBuffer.Len() == 0 &&
-		(c.unAckedMsgBuffer.Len() == 0 || sentMsg.SeqNum-windowSize < c.unAckedMsgBuffer.Front().SeqNum) {
+	bundle := req.val.(*priorityPayloadBundle)
+	c.writeBuffer.Push(NewData(c.connId, 0, bundle.payload), bundle.priority)
+	c.fillWindow()
+	req.replyc <- &retType{nil, nil}
+}
+
+// handle user close write request, an end of stream message is sent after all written messages
+func (c *client) handleCloseWrite(req *request) {
+	if c.connLost {
+		req.replyc <- &retType{nil, errors.New("connection lost")}
+		return
+	}
+	if c.deferedClose.Len() > 0 {
+		req.replyc <- &retType{nil, errors.New("client closed")}
+		return
+	}
+	if c.writeClosed {
+		req.replyc <- &retType{nil, errors.New("write side already closed")}
+		return
+	}
+
+	c.writeClosed = true
+	c.writeBuffer.Push(NewFin(c.connId, 0), PriorityNormal)
+	c.fillWindow()
+	req.replyc <- &retType{nil, nil}
+}
+
+// move messages from the write buffer into unAckedMsgBuffer and send them out via network as long as
+// the next seq num is in the sliding window. messages get their seq nums here, in order of priority
+func (c *client) fillWindow() {
+	for c.writeBuffer.Len() > 0 &&
+		(c.unAckedMsgBuffer.Len() == 0 || c.seqNum+1-c.params.WindowSize < c.unAckedMsgBuffer.Front().SeqNum) {
+		c.seqNum += 1
+		sentMsg := c.writeBuffer.Pop()
+		sentMsg.SeqNum = c.seqNum
 		c.unAckedMsgBuffer.Insert(sentMsg)
-		c.networkUtility.sendMessage(sentMsg)
-	} else {
-		c.writeBuffer.Insert(sentMsg)
+		c.sendMessage(sentMsg)
+	}
+}
+
+// handle user unreliable write request, the message is sent out immediately and never buffered
+func (c *client) handleWriteUnreliable(req *request) {
+	if c.connLost {
+		req.replyc <- &retType{nil, errors.New("connection lost")}
+		return
 	}
+	if c.deferedClose.Len() > 0 {
+		req.replyc <- &retType{nil, errors.New("client closed")}
+		return
+	}
+	if c.writeClosed {
+		req.replyc <- &retType{nil, errors.New("write side closed")}
+		return
+	}
+
+	payload := req.val.([]byte)
+	c.sendMessage(NewData(c.connId, unreliableSeqNum, payload))
 	req.replyc <- &retType{nil, nil}
 }
 
+// return true if the data message with expected seq num is ready in the read buffer
+func (c *client) readReady() bool {
+	return c.readBuffer.Len() > 0 && c.readBuffer.Front().SeqNum == c.expectedSeqNum
+}
+
 // do corresponding actions when epoch fires
 func (c *client) handleEpoch() {
+	// epochs queued up before the connection was lost have nothing left to do
+	if c.connLost {
+		return
+	}
 	c.currEpoch += 1
 	// detect if connection is lost
 	if c.currEpoch-c.latestActiveEpoch >= c.params.EpochLimit {
@@ -184,28 +292,31 @@ func (c *client) handleEpoch() {
 	// if the connection is established but no data messages have been received, send a ack message with seq number 0
 	if c.connId > 0 && c.latestAckBuffer.Len() == 0 && c.deferedClose.Len() == 0 {
 		ackMsg := NewAck(c.connId, 0)
-		c.networkUtility.sendMessage(ackMsg)
+		c.sendMessage(ackMsg)
 	}
 
 	// resend unacknowledged messages in the buffer
 	unAckMsg := c.unAckedMsgBuffer.ReturnAll()
 	for _, msg := range unAckMsg {
-		c.networkUtility.sendMessage(msg)
+		c.sendMessage(msg)
 	}
+	c.stats.Retransmissions += len(unAckMsg)
 
 	// resend latest sent acknowledgements
 	if c.deferedClose.Len() == 0 {
 		latestAck := c.latestAckBuffer.ReturnAll()
 		for _, msg := range latestAck {
-			c.networkUtility.sendMessage(msg)
+			c.sendMessage(msg)
 		}
 	}
 }
 
 // do corresponding actions when a new message comes from network handler
-func (c *client) handleReceivedMsg(req *request) {
+// return true if the message is kept in the read buffer, otherwise the message can be released
+func (c *client) handleReceivedMsg(req *request) bool {
 	// update the latest active epoch interval
 	c.latestActiveEpoch = c.currEpoch
+	c.stats.PacketsReceived += 1
 	receivedMsg := req.val.(*receivedPacket).msg
 	switch receivedMsg.Type {
 	case MsgAck:
@@ -214,50 +325,61 @@ func (c *client) handleReceivedMsg(req *request) {
 
 		// if some messages in the buffer receive ack, check whether messages in the write buffer
 		// can be moved into the unAckedMsgbuffer according to the sliding window size
-		if msgExist && c.writeBuffer.Len() > 0 {
-			if c.unAckedMsgBuffer.Len() == 0 {
-				sentMsg := c.writeBuffer.Remove()
-				c.unAckedMsgBuffer.Insert(sentMsg)
-				c.networkUtility.sendMessage(sentMsg)
-			}
-			wLeft := c.unAckedMsgBuffer.Front().SeqNum
-			wSize := c.params.WindowSize
-			for c.writeBuffer.Len() != 0 {
-				if c.writeBuffer.Front().SeqNum-wSize >= wLeft {
-					break
-				} else {
-					sentMsg := c.writeBuffer.Remove()
-					c.unAckedMsgBuffer.Insert(sentMsg)
-					c.networkUtility.sendMessage(sentMsg)
-				}
-			}
+		if msgExist {
+			c.fillWindow()
 		}
 		// check if the ack message is an ack for the connection message
 		if msgExist && receivedMsg.SeqNum == 0 {
 			c.connId = receivedMsg.ConnID
+			c.credential = receivedMsg.Credential
 			c.connEstablishedSignal <- struct{}{}
 		}
-	case MsgData:
+	case MsgData, MsgFin:
 		// if connection is not established or the client is closed
 		if c.connId == 0 || c.deferedClose.Len() > 0 {
-			return
+			return false
+		}
+
+		// unreliable datagrams are neither acked nor ordered, just queue them for reading
+		if receivedMsg.SeqNum == unreliableSeqNum {
+			if c.datagramBuffer.Len() < maxPendingDatagrams {
+				c.datagramBuffer.PushBack(receivedMsg.Payload)
+			}
+			return false
 		}
 
 		// ignore messages whose seq num is smaller than expected seq num
 		// epoch handler will resend the acks that haven't been received on the other side (if their seq num is smaller than expected seq num)
 		// and the same size of sliding window on both sending and receiving side guarantee the correctness, otherwise we may have to send ack
-		// for every data message we receive no matter whether its seq num is larger or smaller than the expected seq num
-		if receivedMsg.SeqNum >= c.expectedSeqNum {
-			c.readBuffer.Insert(receivedMsg)
+		// for every data message we receive no matter whether its seq num is larger or smaller than the expected seq num.
+		// messages beyond the sliding window after the first message not received yet can't have been sent by a
+		// well-behaved server, they are ignored as well so that the gaps in the read buffer never span more than a window
+		if receivedMsg.SeqNum >= c.expectedSeqNum && receivedMsg.SeqNum < c.receivedSeqNum+c.params.WindowSize {
+			retained := c.readBuffer.Insert(receivedMsg)
+			if !retained {
+				c.stats.DuplicatesReceived += 1
+			}
+			for c.readBuffer.Contains(c.receivedSeqNum) {
+				c.receivedSeqNum += 1
+			}
 			// send ack for the data message and store the ack to latest sent ack buffer
 			ackMsg := NewAck(c.connId, receivedMsg.SeqNum)
 			// send ack message out
-			c.networkUtility.sendMessage(ackMsg)
+			c.sendMessage(ackMsg)
 
 			c.latestAckBuffer.Insert(ackMsg)
 			c.latestAckBuffer.AdjustUsingWindow(c.params.WindowSize)
+			return retained
+		} else {
+			c.stats.DuplicatesReceived += 1
+		}
+	case MsgProbe:
+		// the server saw our messages coming from a new address, echo the challenge to prove we own it
+		if c.connId > 0 && receivedMsg.ConnID == c.connId {
+			c.sendMessage(NewProbe(c.connId, receivedMsg.Payload))
 		}
 	}
+	return false
 }
 
 // handle user get conn id request
@@ -265,6 +387,15 @@ func (c *client) handleConnId(req *request) {
 	req.replyc <- &retType{c.connId, nil}
 }
 
+// handle user get stats request, the counters are copied so the caller gets a consistent snapshot
+func (c *client) handleStats(req *request) {
+	stats := *c.stats
+	stats.UnAckedMsgs = c.unAckedMsgBuffer.Len()
+	stats.PendingWrites = c.writeBuffer.Len()
+	stats.IdleEpochs = c.currEpoch - c.latestActiveEpoch
+	req.replyc <- &retType{&stats, nil}
+}
+
 // handle user close client request
 func (c *client) handleClose(req *request) {
 	// if connection doesn't get lost when user tries to close the client, shut down the epoch timer and network handler go routines
@@ -296,10 +427,17 @@ func (c *client) handleClose(req *request) {
 func (c *client) handleConnect(req *request) {
 	msg := NewConnect()
 	c.unAckedMsgBuffer.Insert(msg)
-	c.networkUtility.sendMessage(msg)
+	c.sendMessage(msg)
 	req.replyc <- &retType{nil, nil}
 }
 
+// send message to the server with the connection credential and count it in the connection stats
+func (c *client) sendMessage(msg *Message) {
+	msg.Credential = c.credential
+	c.networkUtility.sendMessage(msg)
+	c.stats.PacketsSent += 1
+}
+
 // shut down the network handler and epoch timer go routines
 func (c *client) shutDown() {
 	c.networkUtility.close()
@@ -316,7 +454,7 @@ func (c *client) eventHandler() {
 			return
 		}
 		// unblock deferred read if the read buffer is ready or the connection is closed or lost
-		if c.deferedRead.Len() > 0 && ((c.readBuffer.Len() > 0 && c.readBuffer.Front().SeqNum == c.expectedSeqNum) || c.connLost || c.deferedClose.Len() > 0) {
+		if c.deferedRead.Len() > 0 && (c.readReady() || c.datagramBuffer.Len() > 0 || c.connLost || c.deferedClose.Len() > 0) {
 			req = c.deferedRead.Front().Value.(*request)
 			c.deferedRead.Remove(c.deferedRead.Front())
 		} else if c.deferedClose.Len() > 0 && ((c.writeBuffer.Len() == 0 && c.unAckedMsgBuffer.Len() == 0) || c.connLost) {
@@ -327,7 +465,7 @@ func (c *client) eventHandler() {
 			// if there is no need to unblock any deferred request, get new request from reqeust channel
 			req = <-c.requestc
 			// defer read or close request if necessary
-			if req.op == doread && (c.readBuffer.Len() == 0 || c.readBuffer.Front().SeqNum != c.expectedSeqNum) {
+			if req.op == doread && !c.readReady() && c.datagramBuffer.Len() == 0 {
 				c.deferedRead.PushBack(req)
 				continue
 			}
@@ -343,16 +481,26 @@ func (c *client) eventHandler() {
 			c.handleRead(req)
 		case dowrite:
 			c.handleWrite(req)
+		case dowriteunreliable:
+			c.handleWriteUnreliable(req)
+		case doclosewrite:
+			c.handleCloseWrite(req)
 		case doclose:
 			c.handleClose(req)
 		case doconnid:
 			c.handleConnId(req)
+		case dostats:
+			c.handleStats(req)
 		case doconnect:
 			c.handleConnect(req)
 		case epochtimer:
 			c.handleEpoch()
+			releaseEpoch(req)
 		case receivemsg:
-			c.handleReceivedMsg(req)
+			if !c.handleReceivedMsg(req) {
+				releaseMessage(req.val.(*receivedPacket).msg)
+			}
+			releasePacket(req)
 		}
 	}
 }
@@ -3,14 +3,32 @@ package lsp
 const (
 	doread = iota
 	dowrite
+	dowriteunreliable
 	doclose
 	docloseconn
+	doclosewrite
 	doconnid
 	doconnect
+	dostats
 	epochtimer
 	receivemsg
+	deliverread
+	deliverdatagram
+	deliverevent
 )
 
+// data messages carrying this seq num are unreliable datagrams: they live outside the sequence space
+// and the sliding window, and are never acked or retransmitted
+const unreliableSeqNum = 0
+
+// max number of received but unread unreliable datagrams kept per client/server, later ones are dropped
+const maxPendingDatagrams = 256
+
+// max number of connection events of a server waiting to be received from Server.Events, later connections
+// and migrations are dropped, so that a server whose events are never received does not keep them all.
+// lost and closed connections are always reported, see queueEvent
+const maxPendingEvents = 1024
+
 type request struct {
 	op     int
 	val    interface{}
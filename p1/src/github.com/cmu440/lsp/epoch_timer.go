@@ -1,21 +1,36 @@
 // Epoch timer which sends a signal to notify event handelr every $epochMillis$ milliseconds
+// the timer ticks on the virtual clock of lspnet when its simulated network is enabled
 // @author: Chun Chen
 
 package lsp
 
 import (
+	"github.com/cmu440/lspnet"
 	"time"
 )
 
+// the same request is sent on every epoch, the event handler never replies to it or keeps it, but gives it
+// to releaseEpoch once the epoch is handled
 func epochTimer(requestc chan *request, closeSignal chan struct{}, epochMillis int) {
+	ticker := lspnet.NewTicker(time.Millisecond * time.Duration(epochMillis))
+	req := &request{epochtimer, ticker, nil}
+	defer ticker.Stop()
 	for {
 		select {
-		case <-time.After(time.Millisecond * time.Duration(epochMillis)):
-			req := &request{epochtimer, nil, make(chan *retType)}
-			requestc <- req
+		case <-ticker.C:
+			select {
+			case requestc <- req:
+			case <-closeSignal:
+				return
+			}
 		case <-closeSignal:
 			// Shutdown the goroutine.
 			return
 		}
 	}
 }
+
+// tell the virtual clock of lspnet that an epoch is handled
+func releaseEpoch(req *request) {
+	req.val.(*lspnet.Ticker).Handled()
+}
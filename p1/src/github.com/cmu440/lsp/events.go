@@ -0,0 +1,37 @@
+// Contains the connection events delivered by Server.Events
+
+package lsp
+
+import "fmt"
+
+// ConnEventType is an integer code describing a connection event.
+type ConnEventType int
+
+const (
+	ConnConnected ConnEventType = iota // A client established a new connection.
+	ConnClosed                         // The connection was closed explicitly by the server.
+	ConnLost                           // The connection was lost due to an epoch timeout.
+	ConnMigrated                       // The connection moved to a new client address.
+)
+
+// ConnEvent represents a change in the state of a connection on a LSP server.
+type ConnEvent struct {
+	Type   ConnEventType // One of the event types listed above.
+	ConnID int           // Connection ID of the client the event is about.
+	Addr   string        // Client's host:port, only set for ConnConnected and ConnMigrated events.
+}
+
+// String returns a string representation of this event.
+func (e *ConnEvent) String() string {
+	switch e.Type {
+	case ConnConnected:
+		return fmt.Sprintf("[Connected %d %s]", e.ConnID, e.Addr)
+	case ConnClosed:
+		return fmt.Sprintf("[Closed %d]", e.ConnID)
+	case ConnMigrated:
+		return fmt.Sprintf("[Migrated %d %s]", e.ConnID, e.Addr)
+	case ConnLost:
+		return fmt.Sprintf("[Lost %d]", e.ConnID)
+	}
+	return fmt.Sprintf("[Unknown %d]", e.ConnID)
+}
@@ -0,0 +1,115 @@
+// LSP half-close tests.
+
+// These tests check that after CloseWrite on one side, the other side reads
+// all messages written before and then io.EOF, that no more messages can be
+// written on the closed side, and that the opposite direction keeps working.
+
+package lsp
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHalfClose1(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	msgs := []string{"a", "b", "c"}
+	for _, msg := range msgs {
+		cli.Write([]byte(msg))
+	}
+	if err := cli.CloseWrite(); err != nil {
+		t.Fatalf("Client CloseWrite failed: %s", err)
+	}
+	if err := cli.CloseWrite(); err == nil {
+		t.Fatalf("Second client CloseWrite succeeded")
+	}
+	if err := cli.Write([]byte("d")); err == nil {
+		t.Fatalf("Client Write after CloseWrite succeeded")
+	}
+	if err := cli.WriteUnreliable([]byte("d")); err == nil {
+		t.Fatalf("Client WriteUnreliable after CloseWrite succeeded")
+	}
+
+	for _, msg := range msgs {
+		got := readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+		if got != msg {
+			t.Fatalf("Server read %q, expected %q", got, msg)
+		}
+	}
+	type result struct {
+		connID int
+		err    error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		connID, _, err := srv.Read()
+		resc <- result{connID, err}
+	}()
+	select {
+	case res := <-resc:
+		if res.err != io.EOF || res.connID != cli.ConnID() {
+			t.Fatalf("Server read error %v from client %d, expected EOF from client %d", res.err, res.connID, cli.ConnID())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Server read of EOF timed out")
+	}
+
+	// the connection is still open in the other direction
+	if err := srv.Write(cli.ConnID(), []byte("reply")); err != nil {
+		t.Fatalf("Server write failed: %s", err)
+	}
+	if got := readWithTimeout(t, cli.Read, time.Second); got != "reply" {
+		t.Fatalf("Client read %q, expected %q", got, "reply")
+	}
+}
+
+func TestHalfClose2(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 2}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+	connID := cli.ConnID()
+
+	msgs := []string{"a", "b", "c", "d", "e"}
+	for _, msg := range msgs {
+		srv.Write(connID, []byte(msg))
+	}
+	if err := srv.CloseWrite(connID); err != nil {
+		t.Fatalf("Server CloseWrite failed: %s", err)
+	}
+	if err := srv.Write(connID, []byte("f")); err == nil {
+		t.Fatalf("Server Write after CloseWrite succeeded")
+	}
+	if err := srv.CloseWrite(connID + 1); err == nil {
+		t.Fatalf("Server CloseWrite of unknown connection succeeded")
+	}
+
+	for _, msg := range msgs {
+		if got := readWithTimeout(t, cli.Read, time.Second); got != msg {
+			t.Fatalf("Client read %q, expected %q", got, msg)
+		}
+	}
+	// every read after the end of stream returns EOF
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Read(); err != io.EOF {
+			t.Fatalf("Client read error %v, expected EOF", err)
+		}
+	}
+
+	cli.Write([]byte("reply"))
+	got := readWithTimeout(t, func() ([]byte, error) {
+		_, payload, err := srv.Read()
+		return payload, err
+	}, time.Second)
+	if got != "reply" {
+		t.Fatalf("Server read %q, expected %q", got, "reply")
+	}
+}
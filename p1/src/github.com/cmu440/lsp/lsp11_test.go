@@ -0,0 +1,86 @@
+// LSP priority tests.
+
+// These tests hold back acks so that written messages pile up in the send
+// queue, then check that urgent messages are read before the normal ones
+// written earlier, and that each class keeps the order it was written in.
+
+package lsp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+type priorityWrite struct {
+	payload  string
+	priority Priority
+}
+
+var priorityWrites = []priorityWrite{
+	{"n1", PriorityNormal},
+	{"n2", PriorityNormal},
+	{"u1", PriorityUrgent},
+	{"n3", PriorityNormal},
+	{"u2", PriorityUrgent},
+	{"n4", PriorityNormal},
+}
+
+// n1 is sent right away, the rest wait for its ack
+var priorityReads = []string{"n1", "u1", "u2", "n2", "n3", "n4"}
+
+func TestPriority1(t *testing.T) {
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	if err := cli.WriteWithPriority([]byte("x"), numPriorities); err == nil {
+		t.Fatalf("WriteWithPriority with an invalid priority succeeded")
+	}
+	lspnet.SetClientReadDropPercent(100)
+	for _, w := range priorityWrites {
+		if err := cli.WriteWithPriority([]byte(w.payload), w.priority); err != nil {
+			t.Fatalf("Client WriteWithPriority failed: %s", err)
+		}
+	}
+	lspnet.ResetDropPercent()
+
+	for _, expected := range priorityReads {
+		got := readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+		if got != expected {
+			t.Fatalf("Server read %q, expected %q", got, expected)
+		}
+	}
+}
+
+func TestPriority2(t *testing.T) {
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+	connID := cli.ConnID()
+
+	if err := srv.WriteWithPriority(connID, []byte("x"), -1); err == nil {
+		t.Fatalf("WriteWithPriority with an invalid priority succeeded")
+	}
+	lspnet.SetServerReadDropPercent(100)
+	for _, w := range priorityWrites {
+		if err := srv.WriteWithPriority(connID, []byte(w.payload), w.priority); err != nil {
+			t.Fatalf("Server WriteWithPriority failed: %s", err)
+		}
+	}
+	lspnet.ResetDropPercent()
+
+	for _, expected := range priorityReads {
+		if got := readWithTimeout(t, cli.Read, time.Second); got != expected {
+			t.Fatalf("Client read %q, expected %q", got, expected)
+		}
+	}
+}
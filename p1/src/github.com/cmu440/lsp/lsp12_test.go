@@ -0,0 +1,102 @@
+// LSP simulated network tests.
+
+// These tests run the server and client on the simulated network of lspnet.
+// Epochs only pass when the test advances the virtual clock, so connections
+// are lost after many long epochs without any real waiting, and packet drops
+// follow the same schedule on every run with the same seed.
+
+package lsp
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestSimulatedEpochs(t *testing.T) {
+	lspnet.EnableSimulation(1)
+	defer lspnet.DisableSimulation()
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 5, EpochMillis: 60000, WindowSize: 1}
+	epoch := time.Duration(params.EpochMillis) * time.Millisecond
+	start := time.Now()
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	// nothing is lost while epochs pass on a working network
+	cli.Write([]byte("hello"))
+	lspnet.AdvanceClock(2 * time.Duration(params.EpochLimit) * epoch)
+	got := readWithTimeout(t, func() ([]byte, error) {
+		_, payload, err := srv.Read()
+		return payload, err
+	}, time.Second)
+	if got != "hello" {
+		t.Fatalf("Server read %q, expected %q", got, "hello")
+	}
+
+	lspnet.SetClientWriteDropPercent(100)
+	lspnet.SetClientReadDropPercent(100)
+	lspnet.AdvanceClock(time.Duration(params.EpochLimit) * epoch)
+	if _, _, err := srv.Read(); err == nil {
+		t.Fatalf("Server read succeeded, expected the connection to be lost")
+	}
+	if _, err := cli.Read(); err == nil {
+		t.Fatalf("Client read succeeded, expected the connection to be lost")
+	}
+	if elapsed := time.Since(start); elapsed > epoch {
+		t.Fatalf("Test took %s, expected no real waiting for epochs", elapsed)
+	}
+}
+
+// simulatedDropSchedule writes messages one at a time from a client dropping half of its
+// packets, and returns the number of epochs each message took to reach the server.
+func simulatedDropSchedule(t *testing.T, seed int64) []int {
+	lspnet.EnableSimulation(seed)
+	defer lspnet.DisableSimulation()
+	defer lspnet.ResetDropPercent()
+	params := &Params{EpochLimit: 20, EpochMillis: 1000, WindowSize: 1}
+	epoch := time.Duration(params.EpochMillis) * time.Millisecond
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	lspnet.SetClientWriteDropPercent(50)
+	epochs := make([]int, 10)
+	for i := range epochs {
+		msg := strconv.Itoa(i)
+		cli.Write([]byte(msg))
+		// once the network settles the message is acked, unless it was dropped and must be resent
+		lspnet.AdvanceClock(0)
+		for cli.Stats().UnAckedMsgs > 0 {
+			lspnet.AdvanceClock(epoch)
+			epochs[i] += 1
+			if epochs[i] >= params.EpochLimit/2 {
+				t.Fatalf("Message %d not received after %d epochs", i, epochs[i])
+			}
+		}
+		if _, payload, err := srv.Read(); err != nil || string(payload) != msg {
+			t.Fatalf("Server read %q, %v, expected %q", payload, err, msg)
+		}
+	}
+	return epochs
+}
+
+func TestSimulatedDrops(t *testing.T) {
+	first := simulatedDropSchedule(t, 42)
+	second := simulatedDropSchedule(t, 42)
+	t.Logf("Epochs per message: %v", first)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Runs with the same seed took %v and %v epochs per message", first, second)
+	}
+	dropped := 0
+	for _, n := range first {
+		dropped += n
+	}
+	if dropped == 0 {
+		t.Fatalf("No message was dropped")
+	}
+}
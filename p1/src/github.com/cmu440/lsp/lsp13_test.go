@@ -0,0 +1,188 @@
+// LSP network impairment tests.
+
+// These tests delay, duplicate and reorder packets in both directions and
+// check that messages are still read exactly once and in order, that a
+// bandwidth limit slows a stream down, that packet delays follow the
+// virtual clock on the simulated network, and that random delays follow
+// their distribution.
+
+package lsp
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestImpairment1(t *testing.T) {
+	defer lspnet.ResetImpairments()
+	imp := lspnet.Impairment{
+		Delay:            2 * time.Millisecond,
+		Jitter:           20 * time.Millisecond,
+		DuplicatePercent: 30,
+		ReorderWindow:    4,
+	}
+	lspnet.SetClientWriteImpairment(imp)
+	lspnet.SetServerWriteImpairment(imp)
+	params := &Params{EpochLimit: 10, EpochMillis: 500, WindowSize: 8}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+	connID := cli.ConnID()
+
+	const numMsgs = 50
+	for i := 0; i < numMsgs; i++ {
+		cli.Write([]byte(strconv.Itoa(i)))
+		srv.Write(connID, []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < numMsgs; i++ {
+		got := readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, 5*time.Second)
+		if got != strconv.Itoa(i) {
+			t.Fatalf("Server read %q, expected %q", got, strconv.Itoa(i))
+		}
+		if got := readWithTimeout(t, cli.Read, 5*time.Second); got != strconv.Itoa(i) {
+			t.Fatalf("Client read %q, expected %q", got, strconv.Itoa(i))
+		}
+	}
+
+	// the last acks are delayed as well, wait for them so that neither side is closed with
+	// messages in flight, whose acks would be sent after the other side's socket is closed
+	var srvStats, cliStats *ConnStats
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if srvStats, err = srv.Stats(connID); err != nil {
+			t.Fatalf("Server Stats failed: %s", err)
+		}
+		cliStats = cli.Stats()
+		if srvStats.UnAckedMsgs == 0 && cliStats.UnAckedMsgs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages still unacked: server stats %s, client stats %s", srvStats, cliStats)
+		}
+	}
+	t.Logf("Server stats: %s, client stats: %s", srvStats, cliStats)
+	if srvStats.DuplicatesReceived == 0 || cliStats.DuplicatesReceived == 0 {
+		t.Fatalf("No duplicates received, expected some to be suppressed")
+	}
+}
+
+func TestImpairment2(t *testing.T) {
+	defer lspnet.ResetImpairments()
+	const bandwidth = 10000
+	lspnet.SetClientWriteImpairment(lspnet.Impairment{Bandwidth: bandwidth})
+	params := &Params{EpochLimit: 5, EpochMillis: 2000, WindowSize: 10}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	const numMsgs = 10
+	payload := bytes.Repeat([]byte("x"), 1000)
+	start := time.Now()
+	for i := 0; i < numMsgs; i++ {
+		cli.Write(payload)
+	}
+	for i := 0; i < numMsgs; i++ {
+		readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, 5*time.Second)
+	}
+	minElapsed := time.Duration(numMsgs*len(payload)) * time.Second / bandwidth
+	if elapsed := time.Since(start); elapsed < minElapsed {
+		t.Fatalf("Reading %d bytes took %s, expected at least %s at %d bytes/s",
+			numMsgs*len(payload), elapsed, minElapsed, bandwidth)
+	}
+}
+
+func TestImpairment3(t *testing.T) {
+	lspnet.EnableSimulation(1)
+	defer lspnet.DisableSimulation()
+	defer lspnet.ResetImpairments()
+	params := &Params{EpochLimit: 5, EpochMillis: 1000, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	lspnet.SetClientWriteImpairment(lspnet.Impairment{Delay: 3 * time.Second})
+	readc := make(chan string, 1)
+	go func() {
+		_, payload, err := srv.Read()
+		if err == nil {
+			readc <- string(payload)
+		}
+	}()
+	cli.Write([]byte("late"))
+	select {
+	case got := <-readc:
+		t.Fatalf("Server read %q before the delay passed on the virtual clock", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	lspnet.AdvanceClock(3 * time.Second)
+	select {
+	case got := <-readc:
+		if got != "late" {
+			t.Fatalf("Server read %q, expected %q", got, "late")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Server read nothing after the delay passed on the virtual clock")
+	}
+}
+
+func TestImpairment4(t *testing.T) {
+	const numMsgs = 400
+	jitter := 100 * time.Millisecond
+	for _, test := range []struct {
+		name           string
+		dist           lspnet.Distribution
+		minOne, maxOne float64 // bounds of the share of datagrams arriving within one jitter
+		minTwo, maxTwo float64 // and within two
+	}{
+		{"uniform", lspnet.Uniform, 1, 1, 1, 1},
+		// 68% and 95% of a normal variate lie within one and two standard deviations
+		{"normal", lspnet.Normal, 0.6, 0.76, 0.91, 0.99},
+		// 63% and 86% of an exponential variate lie within one and two times its mean
+		{"exponential", lspnet.Exponential, 0.55, 0.71, 0.8, 0.92},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lspnet.EnableSimulation(1)
+			defer lspnet.DisableSimulation()
+			defer lspnet.ResetImpairments()
+			params := &Params{EpochLimit: 5, EpochMillis: 1000, WindowSize: 1}
+			srv, cli := newServerClientPair(t, params)
+			defer srv.Close()
+			defer cli.Close()
+
+			lspnet.SetClientWriteImpairment(lspnet.Impairment{Jitter: jitter, JitterDistribution: test.dist})
+			readc := make(chan []byte, numMsgs)
+			go func() {
+				for {
+					_, payload, err := srv.Read()
+					if err != nil {
+						return
+					}
+					readc <- payload
+				}
+			}()
+			for i := 0; i < numMsgs; i++ {
+				cli.WriteUnreliable([]byte(strconv.Itoa(i)))
+			}
+			// the epochs don't pass, so only the datagrams are delayed
+			for i, bounds := range [][2]float64{{test.minOne, test.maxOne}, {test.minTwo, test.maxTwo}} {
+				lspnet.AdvanceClock(jitter)
+				time.Sleep(50 * time.Millisecond)
+				share := float64(len(readc)) / numMsgs
+				if share < bounds[0] || share > bounds[1] {
+					t.Fatalf("%.0f%% of the datagrams arrived within %s, expected %.0f%% to %.0f%%",
+						100*share, time.Duration(i+1)*jitter, 100*bounds[0], 100*bounds[1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// LSP fault rule tests.
+
+// These tests connect several clients to one server and install fault rules
+// targeting the address of one client only. They check that the server loses
+// that client, or stops hearing from it after a number of packets, while the
+// other clients stay healthy, and that a short partition heals once removed.
+
+package lsp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// connectClients starts a server and connects n clients to it, returning the clients
+// and their addresses as seen by the server.
+func connectClients(t *testing.T, params *Params, n int) (Server, int, []Client, []string) {
+	srv, port := startServer(t, params)
+	clis := make([]Client, n)
+	addrs := make([]string, n)
+	for i := range clis {
+		cli, err := NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), params)
+		if err != nil {
+			t.Fatalf("Failed to create client: %s", err)
+		}
+		event := nextEvent(t, srv, time.Second)
+		if event.Type != ConnConnected || event.ConnID != cli.ConnID() {
+			t.Fatalf("Got event %s, expected connection of client %d", event, cli.ConnID())
+		}
+		clis[i] = cli
+		addrs[i] = event.Addr
+	}
+	return srv, port, clis, addrs
+}
+
+func TestFaultRule1(t *testing.T) {
+	defer lspnet.ResetFaultRules()
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 1}
+	srv, _, clis, addrs := connectClients(t, params, 2)
+	defer srv.Close()
+	lost, healthy := clis[0], clis[1]
+	defer healthy.Close()
+
+	if _, err := lspnet.AddFaultRule(lspnet.FaultRule{Src: addrs[0], DropPercent: 100}); err != nil {
+		t.Fatalf("AddFaultRule failed: %s", err)
+	}
+	healthy.Write([]byte("alive"))
+	got := readWithTimeout(t, func() ([]byte, error) {
+		_, payload, err := srv.Read()
+		return payload, err
+	}, time.Second)
+	if got != "alive" {
+		t.Fatalf("Server read %q, expected %q", got, "alive")
+	}
+
+	event := nextEvent(t, srv, 2*time.Second)
+	if event.Type != ConnLost || event.ConnID != lost.ConnID() {
+		t.Fatalf("Got event %s, expected loss of client %d", event, lost.ConnID())
+	}
+	srv.Write(healthy.ConnID(), []byte("still here"))
+	if got := readWithTimeout(t, healthy.Read, time.Second); got != "still here" {
+		t.Fatalf("Client read %q, expected %q", got, "still here")
+	}
+}
+
+func TestFaultRule2(t *testing.T) {
+	defer lspnet.ResetFaultRules()
+	params := &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 10}
+	srv, _, clis, addrs := connectClients(t, params, 1)
+	defer srv.Close()
+	cli := clis[0]
+
+	// the client's first 3 packets after the rule is added get through
+	const after = 3
+	if _, err := lspnet.AddFaultRule(lspnet.FaultRule{Src: addrs[0], After: after, DropPercent: 100}); err != nil {
+		t.Fatalf("AddFaultRule failed: %s", err)
+	}
+	for i := 0; i < after+2; i++ {
+		cli.Write([]byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < after; i++ {
+		got := readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+		if got != strconv.Itoa(i) {
+			t.Fatalf("Server read %q, expected %q", got, strconv.Itoa(i))
+		}
+	}
+	event := nextEvent(t, srv, 3*time.Second)
+	if event.Type != ConnLost || event.ConnID != cli.ConnID() {
+		t.Fatalf("Got event %s, expected loss of client %d", event, cli.ConnID())
+	}
+}
+
+func TestFaultRule3(t *testing.T) {
+	defer lspnet.ResetFaultRules()
+	if _, err := lspnet.AddFaultRule(lspnet.FaultRule{Src: "no port"}); err == nil {
+		t.Fatalf("AddFaultRule succeeded with an invalid address")
+	}
+
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 1}
+	srv, port, clis, addrs := connectClients(t, params, 2)
+	defer srv.Close()
+	partitioned, healthy := clis[0], clis[1]
+	defer partitioned.Close()
+	defer healthy.Close()
+
+	serverAddr := lspnet.JoinHostPort("localhost", strconv.Itoa(port))
+	ids, err := lspnet.Partition([]string{serverAddr}, addrs[:1])
+	if err != nil {
+		t.Fatalf("Partition failed: %s", err)
+	}
+	srv.Write(partitioned.ConnID(), []byte("delayed"))
+	srv.Write(healthy.ConnID(), []byte("on time"))
+	if got := readWithTimeout(t, healthy.Read, time.Second); got != "on time" {
+		t.Fatalf("Client read %q, expected %q", got, "on time")
+	}
+
+	// heal the partition before either side gives up on the other
+	time.Sleep(2 * time.Duration(params.EpochMillis) * time.Millisecond)
+	for _, id := range ids {
+		lspnet.RemoveFaultRule(id)
+	}
+	if got := readWithTimeout(t, partitioned.Read, time.Second); got != "delayed" {
+		t.Fatalf("Client read %q, expected %q", got, "delayed")
+	}
+	select {
+	case event := <-srv.Events():
+		t.Fatalf("Got event %s, expected no connection to be lost", event)
+	default:
+	}
+}
@@ -0,0 +1,134 @@
+// LSP packet capture tests.
+
+// These tests record the datagrams of a connection with lspnet.StartCapture
+// and read the capture back. They check that every datagram is recorded as
+// sent by one socket and received by the other, with the addresses of both,
+// and that the recorded payloads decode to the messages exchanged.
+
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// readCapture decodes all records of a capture to LSP messages.
+func readCapture(t *testing.T, capture []byte) ([]*lspnet.CaptureRecord, []*Message) {
+	cr, err := lspnet.NewCaptureReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("NewCaptureReader failed: %s", err)
+	}
+	var records []*lspnet.CaptureRecord
+	var msgs []*Message
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records, msgs
+		} else if err != nil {
+			t.Fatalf("Next failed after %d records: %s", len(records), err)
+		}
+		var msg Message
+		if err := json.Unmarshal(rec.Payload, &msg); err != nil {
+			t.Fatalf("Recorded payload %q is not a message: %s", rec.Payload, err)
+		}
+		records = append(records, rec)
+		msgs = append(msgs, &msg)
+	}
+}
+
+func TestCapture1(t *testing.T) {
+	var capture bytes.Buffer
+	if err := lspnet.StartCapture(&capture); err != nil {
+		t.Fatalf("StartCapture failed: %s", err)
+	}
+	params := &Params{EpochLimit: 5, EpochMillis: 200, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	connID := cli.ConnID()
+	cli.Write([]byte("ping"))
+	readWithTimeout(t, func() ([]byte, error) {
+		_, payload, err := srv.Read()
+		return payload, err
+	}, time.Second)
+	srv.Write(connID, []byte("pong"))
+	readWithTimeout(t, cli.Read, time.Second)
+	cli.Close()
+	srv.Close()
+	if err := lspnet.StopCapture(); err != nil {
+		t.Fatalf("StopCapture failed: %s", err)
+	}
+
+	records, msgs := readCapture(t, capture.Bytes())
+	if len(msgs) == 0 || msgs[0].Type != MsgConnect || !records[0].Sent {
+		t.Fatalf("First record is not the connect message sent by the client")
+	}
+	clientAddr, serverAddr := records[0].Local, records[0].Remote
+	sent := make(map[string]int)
+	received := make(map[string]int)
+	for i, rec := range records {
+		if i > 0 && rec.Time.Before(records[i-1].Time) {
+			t.Fatalf("Record %d is older than the one before", i)
+		}
+		if rec.Sent {
+			sent[msgs[i].String()] += 1
+		} else {
+			received[msgs[i].String()] += 1
+			if rec.Remote != clientAddr && rec.Local != clientAddr {
+				t.Fatalf("Record %d received on %s from %s, expected an address of the client", i, rec.Local, rec.Remote)
+			}
+		}
+	}
+	for _, msg := range []*Message{NewConnect(), NewData(connID, 1, []byte("ping")), NewData(connID, 1, []byte("pong"))} {
+		if sent[msg.String()] == 0 || received[msg.String()] == 0 {
+			t.Fatalf("Message %s sent %d and received %d times, expected both", msg, sent[msg.String()], received[msg.String()])
+		}
+	}
+	t.Logf("Captured %d datagrams between %s and %s", len(records), clientAddr, serverAddr)
+
+	// nothing is recorded once the capture is stopped
+	size := capture.Len()
+	srv, cli = newServerClientPair(t, params)
+	cli.Close()
+	srv.Close()
+	if capture.Len() != size {
+		t.Fatalf("Capture grew after StopCapture")
+	}
+}
+
+func TestCapture2(t *testing.T) {
+	if _, err := lspnet.NewCaptureReader(bytes.NewReader([]byte("not a capture"))); err == nil {
+		t.Fatalf("NewCaptureReader succeeded on a file which isn't a capture")
+	}
+
+	lspnet.EnableSimulation(1)
+	defer lspnet.DisableSimulation()
+	var capture bytes.Buffer
+	lspnet.StartCapture(&capture)
+	params := &Params{EpochLimit: 5, EpochMillis: 1000, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	lspnet.AdvanceClock(3 * time.Second)
+	cli.Close()
+	srv.Close()
+	lspnet.StopCapture()
+
+	// datagrams are stamped with the virtual clock on the simulated network
+	records, _ := readCapture(t, capture.Bytes())
+	last := records[len(records)-1].Time
+	if last.Before(time.Unix(3, 0)) || last.After(time.Unix(4, 0)) {
+		t.Fatalf("Last record at %s, expected 3s after the start of the virtual clock", last)
+	}
+
+	// a capture cut in the middle of a record is reported as such
+	cr, _ := lspnet.NewCaptureReader(bytes.NewReader(capture.Bytes()[:capture.Len()-1]))
+	for {
+		if _, err := cr.Next(); err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next returned %v on a truncated capture, expected %v", err, io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// LSP sliding window bound tests.
+
+// These tests play one side of a connection over raw UDP sockets and send
+// data messages beyond the receiver's sliding window. They check that such
+// messages are neither acked nor buffered, however far beyond the window
+// they are, and that the connection keeps working afterwards, also when the
+// receiver doesn't read the messages it has acked.
+
+package lsp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestOutOfWindow1(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 2}
+	srv, port := startServer(t, params)
+	defer srv.Close()
+
+	c := dialRawPeer(t, port)
+	defer c.conn.Close()
+	c.send(NewConnect())
+	ack := c.expect(MsgAck, 0)
+	send := func(seqNum int, payload string) {
+		msg := NewData(ack.ConnID, seqNum, []byte(payload))
+		msg.Credential = ack.Credential
+		c.send(msg)
+	}
+
+	// the server expects seq num 1, so seq nums 3 and above are beyond its window
+	for _, seqNum := range []int{1 << 36, 3} {
+		send(seqNum, "far")
+		if got := c.receive(MsgAck, seqNum, 3*time.Duration(params.EpochMillis)*time.Millisecond); got != nil {
+			t.Fatalf("Server acked %s beyond its window", got)
+		}
+	}
+
+	send(2, "two")
+	c.expect(MsgAck, 2)
+	send(1, "one")
+	c.expect(MsgAck, 1)
+	for _, expected := range []string{"one", "two"} {
+		got := readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+		if got != expected {
+			t.Fatalf("Server read %q, expected %q", got, expected)
+		}
+	}
+}
+
+func TestOutOfWindow2(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 2}
+	s, port := listenRawPeer(t)
+	defer s.conn.Close()
+
+	type result struct {
+		cli Client
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		cli, err := NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), params)
+		resc <- result{cli, err}
+	}()
+	s.expect(MsgConnect, 0)
+	const connID = 7
+	s.send(NewAck(connID, 0))
+	res := <-resc
+	if res.err != nil {
+		t.Fatalf("Failed to create client: %s", res.err)
+	}
+	cli := res.cli
+	defer cli.Close()
+
+	s.send(NewData(connID, 1<<36, []byte("far")))
+	if got := s.receive(MsgAck, 1<<36, 3*time.Duration(params.EpochMillis)*time.Millisecond); got != nil {
+		t.Fatalf("Client acked %s beyond its window", got)
+	}
+
+	// the window moves on with the messages received in order, not with the messages read
+	payloads := []string{"one", "two", "three", "four"}
+	for i, payload := range payloads {
+		s.send(NewData(connID, i+1, []byte(payload)))
+		s.expect(MsgAck, i+1)
+	}
+	for _, expected := range payloads {
+		if got := readWithTimeout(t, cli.Read, time.Second); got != expected {
+			t.Fatalf("Client read %q, expected %q", got, expected)
+		}
+	}
+}
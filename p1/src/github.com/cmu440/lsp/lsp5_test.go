@@ -0,0 +1,135 @@
+// LSP unreliable datagram tests.
+
+// These tests start a server and a single client and check that payloads
+// sent with WriteUnreliable are delivered to the other side when no packets
+// are dropped, without disturbing the reliable, in-order message stream.
+
+package lsp
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func startServer(t *testing.T, params *Params) (Server, int) {
+	const numTries = 5
+	var srv Server
+	var err error
+	var port int
+	for i := 0; i < numTries && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		srv, err = NewServer(port, params)
+		if err != nil {
+			t.Logf("Failed to start server on port %d: %s", port, err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server.")
+	}
+	return srv, port
+}
+
+func newServerClientPair(t *testing.T, params *Params) (Server, Client) {
+	srv, port := startServer(t, params)
+	cli, err := NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), params)
+	if err != nil {
+		t.Fatalf("Failed to create client: %s", err)
+	}
+	return srv, cli
+}
+
+func readWithTimeout(t *testing.T, read func() ([]byte, error), timeout time.Duration) string {
+	type result struct {
+		payload []byte
+		err     error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		payload, err := read()
+		resc <- result{payload, err}
+	}()
+	select {
+	case res := <-resc:
+		if res.err != nil {
+			t.Fatalf("Read returned error: %s", res.err)
+		}
+		return string(res.payload)
+	case <-time.After(timeout):
+		t.Fatalf("Read timed out after %s", timeout)
+	}
+	return ""
+}
+
+func TestDatagram1(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	if err := cli.WriteUnreliable([]byte("ping")); err != nil {
+		t.Fatalf("Client WriteUnreliable failed: %s", err)
+	}
+	var connID int
+	got := readWithTimeout(t, func() ([]byte, error) {
+		id, payload, err := srv.Read()
+		connID = id
+		return payload, err
+	}, time.Second)
+	if got != "ping" || connID != cli.ConnID() {
+		t.Fatalf("Server read %q from client %d, expected %q from client %d", got, connID, "ping", cli.ConnID())
+	}
+
+	if err := srv.WriteUnreliable(connID, []byte("pong")); err != nil {
+		t.Fatalf("Server WriteUnreliable failed: %s", err)
+	}
+	if got := readWithTimeout(t, cli.Read, time.Second); got != "pong" {
+		t.Fatalf("Client read %q, expected %q", got, "pong")
+	}
+}
+
+func TestDatagram2(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 5}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	// Interleave reliable and unreliable writes; reliable messages must still
+	// be read in order, and every datagram must show up exactly once.
+	const numMsgs = 10
+	for i := 0; i < numMsgs; i++ {
+		cli.Write([]byte("r" + strconv.Itoa(i)))
+		cli.WriteUnreliable([]byte("u" + strconv.Itoa(i)))
+	}
+	nextReliable, datagrams := 0, make(map[string]bool)
+	for i := 0; i < 2*numMsgs; i++ {
+		got := readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+		if got[0] == 'r' {
+			if expected := "r" + strconv.Itoa(nextReliable); got != expected {
+				t.Fatalf("Server read %q, expected %q", got, expected)
+			}
+			nextReliable++
+		} else if datagrams[got] {
+			t.Fatalf("Server read datagram %q twice", got)
+		} else {
+			datagrams[got] = true
+		}
+	}
+}
+
+func TestDatagram3(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	if err := srv.WriteUnreliable(cli.ConnID()+1, []byte("nobody")); err == nil {
+		t.Fatalf("Server WriteUnreliable to unknown connection should return an error")
+	}
+}
@@ -0,0 +1,63 @@
+// LSP connection statistics tests.
+
+// These tests check that Client.Stats and Server.Stats account for the
+// packets exchanged by a simple stream of messages from client to server.
+
+package lsp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStats1(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 5}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+	defer cli.Close()
+
+	const numMsgs = 10
+	for i := 0; i < numMsgs; i++ {
+		if err := cli.Write([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Client write failed: %s", err)
+		}
+	}
+	for i := 0; i < numMsgs; i++ {
+		readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+	}
+
+	// Give the last acks a moment to reach the client.
+	time.Sleep(100 * time.Millisecond)
+	cliStats := cli.Stats()
+	t.Logf("Client stats: %s", cliStats)
+	if cliStats.PacketsSent < numMsgs+1 {
+		t.Errorf("Client sent %d packets, expected at least %d", cliStats.PacketsSent, numMsgs+1)
+	}
+	if cliStats.PacketsReceived < numMsgs+1 {
+		t.Errorf("Client received %d packets, expected at least %d", cliStats.PacketsReceived, numMsgs+1)
+	}
+	if cliStats.UnAckedMsgs != 0 || cliStats.PendingWrites != 0 {
+		t.Errorf("Client has %d unacked and %d pending messages, expected none",
+			cliStats.UnAckedMsgs, cliStats.PendingWrites)
+	}
+
+	srvStats, err := srv.Stats(cli.ConnID())
+	if err != nil {
+		t.Fatalf("Server Stats failed: %s", err)
+	}
+	t.Logf("Server stats: %s", srvStats)
+	if srvStats.PacketsReceived < numMsgs+1 {
+		t.Errorf("Server received %d packets, expected at least %d", srvStats.PacketsReceived, numMsgs+1)
+	}
+	if srvStats.PacketsSent < numMsgs+1 {
+		t.Errorf("Server sent %d packets, expected at least %d", srvStats.PacketsSent, numMsgs+1)
+	}
+
+	if _, err := srv.Stats(cli.ConnID() + 1); err == nil {
+		t.Errorf("Server Stats for unknown connection should return an error")
+	}
+}
@@ -0,0 +1,92 @@
+// LSP connection event tests.
+
+// These tests check that Server.Events reports clients connecting, being
+// closed by the server, and being lost after the epoch limit, in order, and
+// that the ends of connections are never dropped while events pile up.
+
+package lsp
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, srv Server, timeout time.Duration) *ConnEvent {
+	select {
+	case event, ok := <-srv.Events():
+		if !ok {
+			t.Fatalf("Event channel closed unexpectedly")
+		}
+		t.Logf("Server event: %s", event)
+		return event
+	case <-time.After(timeout):
+		t.Fatalf("No event after %s", timeout)
+	}
+	return nil
+}
+
+func TestEvents1(t *testing.T) {
+	params := &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+
+	event := nextEvent(t, srv, time.Second)
+	if event.Type != ConnConnected || event.ConnID != cli.ConnID() || event.Addr == "" {
+		t.Fatalf("Got event %s, expected connection of client %d", event, cli.ConnID())
+	}
+
+	if err := srv.CloseConn(cli.ConnID()); err != nil {
+		t.Fatalf("CloseConn failed: %s", err)
+	}
+	event = nextEvent(t, srv, time.Second)
+	if event.Type != ConnClosed || event.ConnID != cli.ConnID() {
+		t.Fatalf("Got event %s, expected close of client %d", event, cli.ConnID())
+	}
+	cli.Close()
+}
+
+func TestEvents2(t *testing.T) {
+	params := &Params{EpochLimit: 3, EpochMillis: 100, WindowSize: 1}
+	srv, cli := newServerClientPair(t, params)
+	defer srv.Close()
+
+	event := nextEvent(t, srv, time.Second)
+	if event.Type != ConnConnected {
+		t.Fatalf("Got event %s, expected connection of client %d", event, cli.ConnID())
+	}
+
+	// A closed client stops sending heartbeats, so the server loses it
+	// after EpochLimit epochs.
+	connID := cli.ConnID()
+	cli.Close()
+	event = nextEvent(t, srv, time.Duration(2*params.EpochLimit*params.EpochMillis)*time.Millisecond)
+	if event.Type != ConnLost || event.ConnID != connID {
+		t.Fatalf("Got event %s, expected loss of client %d", event, connID)
+	}
+}
+
+func TestEvents3(t *testing.T) {
+	s := &server{pendingEvents: list.New()}
+	s.queueEvent(&ConnEvent{ConnMigrated, 1, "127.0.0.1:1001"})
+	for connID := 2; s.pendingEvents.Len() < maxPendingEvents; connID++ {
+		s.queueEvent(&ConnEvent{ConnConnected, connID, "127.0.0.1:1000"})
+	}
+	// Nobody receives the events: later connections are dropped, while the
+	// latest migration is merged into the waiting one and ends are kept.
+	s.queueEvent(&ConnEvent{ConnMigrated, 1, "127.0.0.1:1002"})
+	s.queueEvent(&ConnEvent{ConnConnected, 5000, "127.0.0.1:1000"})
+	s.queueEvent(&ConnEvent{ConnLost, 1, ""})
+	s.queueEvent(&ConnEvent{ConnClosed, 2, ""})
+	if n := s.pendingEvents.Len(); n != maxPendingEvents+2 {
+		t.Fatalf("%d events pending, expected %d", n, maxPendingEvents+2)
+	}
+	if event := s.pendingEvents.Front().Value.(*ConnEvent); event.Addr != "127.0.0.1:1002" {
+		t.Fatalf("Got event %s first, expected the latest migration of client 1", event)
+	}
+	lost := s.pendingEvents.Back().Prev().Value.(*ConnEvent)
+	closed := s.pendingEvents.Back().Value.(*ConnEvent)
+	if lost.Type != ConnLost || lost.ConnID != 1 || closed.Type != ConnClosed || closed.ConnID != 2 {
+		t.Fatalf("Got events %s and %s last, expected loss of client 1 and close of client 2", lost, closed)
+	}
+}
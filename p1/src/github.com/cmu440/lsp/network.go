@@ -7,25 +7,70 @@ package lsp
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/cmu440/lspnet"
+	"strings"
+	"sync"
 )
 
 type receivedPacket struct {
 	msg   *Message
 	raddr *lspnet.UDPAddr
+	conn  *lspnet.UDPConn // local socket the packet arrived on, replies must be sent from it
 }
 
 type networkUtility struct {
-	conn        *lspnet.UDPConn
-	requestc    chan *request
+	conns       []*lspnet.UDPConn // the dialed socket on client side, one socket per listening address on server side
+	deliver     func(*request)
 	closeSignal chan struct{}
 }
 
-// create a new network utility
-func NewNetworkUtility(requestc chan *request) *networkUtility {
+// pools which keep the receive path from allocating a message, a packet and a request for every datagram.
+// a receivemsg request is given back by releasePacket once the event handler is done with it (which also tells
+// the simulated network of lspnet that the packet is handled), and its message by releaseMessage once the message
+// is neither needed nor kept in any buffer
+var (
+	messagePool = sync.Pool{New: func() interface{} { return new(Message) }}
+	packetPool  = sync.Pool{New: func() interface{} { return &request{receivemsg, new(receivedPacket), nil} }}
+)
+
+// get a zeroed message from the message pool
+func newMessage() *Message {
+	msg := messagePool.Get().(*Message)
+	*msg = Message{}
+	return msg
+}
+
+// give a received message back to the message pool
+func releaseMessage(msg *Message) {
+	messagePool.Put(msg)
+}
+
+// get a receivemsg request carrying the given message and address from the packet pool
+func newPacketRequest(msg *Message, raddr *lspnet.UDPAddr, conn *lspnet.UDPConn) *request {
+	req := packetPool.Get().(*request)
+	packet := req.val.(*receivedPacket)
+	packet.msg = msg
+	packet.raddr = raddr
+	packet.conn = conn
+	return req
+}
+
+// give a receivemsg request back to the packet pool, its message is not released
+func releasePacket(req *request) {
+	packet := req.val.(*receivedPacket)
+	packet.conn.Handled()
+	packet.msg = nil
+	packet.raddr = nil
+	packet.conn = nil
+	packetPool.Put(req)
+}
+
+// create a new network utility, received packets are passed to the deliver function as receivemsg requests
+func NewNetworkUtility(deliver func(*request)) *networkUtility {
 	handler := &networkUtility{
-		conn:        nil,
-		requestc:    requestc,
+		conns:       nil,
+		deliver:     deliver,
 		closeSignal: make(chan struct{}),
 	}
 	return handler
@@ -41,24 +86,44 @@ func (h *networkUtility) dial(hostport string) error {
 	if err != nil {
 		return err
 	}
-	h.conn = conn
+	h.conns = []*lspnet.UDPConn{conn}
 	return nil
 }
 
-// listen to incoming UDP data using the given hostport, used on server side
-func (h *networkUtility) listen(hostport string) error {
-	serverAddr, err := lspnet.ResolveUDPAddr("udp", hostport)
-	if err != nil {
-		return nil
-	}
-	conn, err := lspnet.ListenUDP("udp", serverAddr)
-	if err != nil {
+// listen to incoming UDP data on each of the comma separated hostports given, used on server side.
+// a hostport may name a specific IPv4 or IPv6 address (e.g. "127.0.0.1:9999" or "[::1]:9999"), or leave
+// the host empty (e.g. ":9999") to listen on all addresses. if any of them fails, none is left listening
+func (h *networkUtility) listen(hostports string) error {
+	for _, hostport := range strings.Split(hostports, ",") {
+		hostport = strings.TrimSpace(hostport)
+		if hostport == "" {
+			continue
+		}
+		serverAddr, err := lspnet.ResolveUDPAddr("udp", hostport)
+		if err == nil {
+			var conn *lspnet.UDPConn
+			conn, err = lspnet.ListenUDP("udp", serverAddr)
+			if err == nil {
+				h.conns = append(h.conns, conn)
+				continue
+			}
+		}
+		h.closeConns()
 		return err
 	}
-	h.conn = conn
+	if len(h.conns) == 0 {
+		return errors.New("no address to listen on")
+	}
 	return nil
 }
 
+// start one network handler go routine for each socket
+func (h *networkUtility) start() {
+	for _, conn := range h.conns {
+		go h.networkHandler(conn)
+	}
+}
+
 // send message via UDP protocal, used on client side
 func (h *networkUtility) sendMessage(msg *Message) error {
 	buf, err := json.Marshal(msg)
@@ -66,53 +131,68 @@ func (h *networkUtility) sendMessage(msg *Message) error {
 		return err
 	}
 
-	_, err = h.conn.Write(buf)
+	_, err = h.conns[0].Write(buf)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// send message via UDP protocal to the given remote address, used on server side
-func (h *networkUtility) sendMessageToAddr(raddr *lspnet.UDPAddr, msg *Message) error {
+// send message via UDP protocal from the given local socket to the given remote address, used on server side
+func (h *networkUtility) sendMessageToAddr(conn *lspnet.UDPConn, raddr *lspnet.UDPAddr, msg *Message) error {
 	buf, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	_, err = h.conn.WriteToUDP(buf, raddr)
+	_, err = conn.WriteToUDP(buf, raddr)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// network handler go routine which receives incoming UDP data, unmarshall it and send it to event handler via channel
-func (h *networkUtility) networkHandler() {
+// network handler go routine which receives incoming UDP data from a socket, unmarshall it and pass it to the deliver
+// function. the read buffer, messages and requests are all reused, so no reply channel or packet is allocated per datagram
+func (h *networkUtility) networkHandler(conn *lspnet.UDPConn) {
 	buf := make([]byte, 1500)
 	for {
 		select {
 		case <-h.closeSignal:
 			return
 		default:
-			n, addr, err := h.conn.ReadFromUDP(buf[0:])
+			n, addr, err := conn.ReadFromUDP(buf[0:])
 			if err == nil {
-				msg := &Message{}
-				err = json.Unmarshal(buf[:n], msg)
-				if err == nil {
-					packet := &receivedPacket{msg, addr}
-					req := &request{receivemsg, packet, make(chan *retType)}
-					h.requestc <- req
-				}
+				h.handleDatagram(buf[:n], addr, conn)
 			}
 		}
 	}
 }
 
-// shut the network handler go routine down
+// unmarshall a datagram received on a socket into a pooled message, and pass it to the deliver function in a
+// pooled receivemsg request. a datagram which is not a message is dropped
+func (h *networkUtility) handleDatagram(buf []byte, addr *lspnet.UDPAddr, conn *lspnet.UDPConn) {
+	msg := newMessage()
+	if err := json.Unmarshal(buf, msg); err != nil {
+		releaseMessage(msg)
+		conn.Handled()
+		return
+	}
+	h.deliver(newPacketRequest(msg, addr, conn))
+}
+
+// shut all network handler go routines down
 func (h *networkUtility) close() {
-	if h.conn != nil {
-		h.conn.Close()
-		h.closeSignal <- struct{}{}
+	if len(h.conns) > 0 {
+		h.closeConns()
+		close(h.closeSignal)
+	}
+}
+
+// close all sockets
+func (h *networkUtility) closeConns() {
+	for _, conn := range h.conns {
+		conn.Close()
 	}
+	h.conns = nil
 }
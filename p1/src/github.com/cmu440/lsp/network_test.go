@@ -0,0 +1,131 @@
+// Network handler benchmarks.
+
+// BenchmarkReceivePath measures the cost (and allocations) per packet of the
+// path from the UDP socket through networkHandler to the event handler.
+// BenchmarkDecode measures the decode and dispatch step of networkHandler on
+// its own, with the pools and with the allocations they replaced, and
+// TestReceivePathAllocs checks that the pools are actually reused.
+
+package lsp
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/cmu440/lspnet"
+)
+
+func BenchmarkReceivePath(b *testing.B) {
+	receivedc := make(chan struct{}, 1)
+	h := NewNetworkUtility(func(req *request) {
+		releaseMessage(req.val.(*receivedPacket).msg)
+		releasePacket(req)
+		receivedc <- struct{}{}
+	})
+	var port int
+	var err error
+	for i := 0; i < 5; i++ {
+		port = 3000 + rand.Intn(50000)
+		if err = h.listen(":" + strconv.Itoa(port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		b.Fatalf("Failed to listen: %s", err)
+	}
+	h.start()
+	defer h.close()
+
+	raddr, _ := lspnet.ResolveUDPAddr("udp", lspnet.JoinHostPort("localhost", strconv.Itoa(port)))
+	conn, err := lspnet.DialUDP("udp", nil, raddr)
+	if err != nil {
+		b.Fatalf("Failed to dial: %s", err)
+	}
+	defer conn.Close()
+	packet, _ := json.Marshal(NewAck(1, 1))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(packet)
+		<-receivedc
+	}
+}
+
+// the decode and dispatch step as it was before the pools: a message, a packet, a request and a
+// reply channel for every datagram
+func handleDatagramUnpooled(h *networkUtility, buf []byte, addr *lspnet.UDPAddr, conn *lspnet.UDPConn) {
+	msg := &Message{}
+	if err := json.Unmarshal(buf, msg); err != nil {
+		return
+	}
+	h.deliver(&request{receivemsg, &receivedPacket{msg, addr, conn}, make(chan *retType)})
+}
+
+// a network utility whose deliver function gives pooled packets back, like the event handlers do, and
+// the arguments of handleDatagram for a datagram carrying the given message
+func newDecodeBench(t testing.TB, msg *Message, pooled bool) (*networkUtility, []byte, *lspnet.UDPAddr, *lspnet.UDPConn) {
+	h := NewNetworkUtility(func(req *request) {})
+	if pooled {
+		h.deliver = func(req *request) {
+			releaseMessage(req.val.(*receivedPacket).msg)
+			releasePacket(req)
+		}
+	}
+	laddr, _ := lspnet.ResolveUDPAddr("udp", "127.0.0.1:0")
+	conn, err := lspnet.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	raddr, _ := lspnet.ResolveUDPAddr("udp", "127.0.0.1:9999")
+	buf, _ := json.Marshal(msg)
+	return h, buf, raddr, conn
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		msg  *Message
+	}{
+		{"Ack", NewAck(1, 1)},
+		{"Data", NewData(1, 1, make([]byte, 64))},
+	} {
+		for _, pooled := range []bool{true, false} {
+			name := bench.name + "/Unpooled"
+			if pooled {
+				name = bench.name + "/Pooled"
+			}
+			b.Run(name, func(b *testing.B) {
+				h, buf, raddr, conn := newDecodeBench(b, bench.msg, pooled)
+				defer conn.Close()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if pooled {
+						h.handleDatagram(buf, raddr, conn)
+					} else {
+						handleDatagramUnpooled(h, buf, raddr, conn)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReceivePathAllocs(t *testing.T) {
+	msg := NewAck(1, 1)
+	h, buf, raddr, conn := newDecodeBench(t, msg, true)
+	defer conn.Close()
+	pooled := testing.AllocsPerRun(1000, func() { h.handleDatagram(buf, raddr, conn) })
+	h, buf, raddr, conn = newDecodeBench(t, msg, false)
+	defer conn.Close()
+	unpooled := testing.AllocsPerRun(1000, func() { handleDatagramUnpooled(h, buf, raddr, conn) })
+	t.Logf("%.1f allocations per datagram with the pools, %.1f without", pooled, unpooled)
+	// the message, packet, request and reply channel come from the pools or are gone, only decoding allocates
+	if pooled > unpooled-3 {
+		t.Fatalf("%.1f allocations per datagram with the pools, expected at least 3 fewer than the %.1f without",
+			pooled, unpooled)
+	}
+}
@@ -1,4 +1,5 @@
-// DO NOT MODIFY THIS FILE!
+// Defines the interface of a LSP server. The handout's API is extended in place,
+// so changes must keep the existing methods and their behaviour unchanged.
 
 package lsp
 
@@ -13,7 +14,9 @@ type Server interface {
 	// client are waiting to be returned, or (3) the server has been closed.
 	// In the first two cases, the client's connection ID and a non-nil
 	// error should be returned. In the third case, an ID with value 0 and
-	// a non-nil error should be returned.
+	// a non-nil error should be returned. Once a client has called CloseWrite
+	// and all messages it wrote before have been returned, the client's
+	// connection ID and io.EOF are returned once.
 	Read() (int, []byte, error)
 
 	// Write sends a data message to the client with the specified connection ID.
@@ -21,6 +24,45 @@ type Server interface {
 	// connection with the client has been lost.
 	Write(connID int, payload []byte) error
 
+	// WriteWithPriority is like Write, but sends the message in the given priority
+	// class. Pending messages of higher classes are sent (and read by the client)
+	// before pending messages of lower classes to the same client, while messages
+	// of the same class keep the order they are written in. Write uses
+	// PriorityNormal. It should return a non-nil error if the priority is not a
+	// valid class.
+	WriteWithPriority(connID int, payload []byte, priority Priority) error
+
+	// WriteUnreliable sends a data message to the client with the specified connection
+	// ID outside the sequence space and sliding window. The message is never
+	// acknowledged or retransmitted, so it may be lost or arrive out of order
+	// with respect to other messages. This method should NOT block, and should
+	// return a non-nil error if the connection with the client has been lost.
+	WriteUnreliable(connID int, payload []byte) error
+
+	// CloseWrite ends the stream of data messages to the client with the specified
+	// connection ID, while the connection stays open for reading. Once the client
+	// has read all messages written before, its Read returns io.EOF. Write and
+	// WriteUnreliable to the client return a non-nil error after CloseWrite. This
+	// method should NOT block, and should return a non-nil error if the connection
+	// has been closed or lost, or CloseWrite has already been called for it.
+	CloseWrite(connID int) error
+
+	// Events returns a channel delivering a ConnEvent whenever a client connects
+	// (ConnConnected), a connection is closed by CloseConn (ConnClosed), a
+	// connection is lost due to an epoch timeout (ConnLost), or a connection
+	// moves to a new client address (ConnMigrated). Events are delivered
+	// in the order they happen. Migrations of a connection waiting to be received
+	// are merged into one with the latest address. Up to 1024 events wait to be
+	// received from the channel, ConnConnected and ConnMigrated events happening
+	// while that many are waiting are dropped. ConnClosed and ConnLost events are
+	// never dropped, so every connection ends with one of them. The channel is
+	// closed once the server has shut down.
+	Events() <-chan *ConnEvent
+
+	// Stats returns a snapshot of the statistics of the connection with the specified
+	// connection ID, returning a non-nil error if the connection ID does not exist.
+	Stats(connID int) (*ConnStats, error)
+
 	// CloseConn terminates the client with the specified connection ID, returning
 	// a non-nil error if the specified connection ID does not exist. All pending
 	// messages to the client should be sent and acknowledged. However, unlike Close,
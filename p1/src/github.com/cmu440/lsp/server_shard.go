@@ -0,0 +1,567 @@
+// Contains the implementation of a LSP server shard. Connections of a server are spread over several shards
+// keyed by connection ID, each shard has its own event handler and epoch timer, so that the work of different
+// connections is done in parallel. In-order data messages and connection events are handed over to the server,
+// which serves them to Read and Events.
+
+package lsp
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/cmu440/lspnet"
+	"io"
+)
+
+// size of the random challenge sent to validate a client's new address
+const challengeSize = 8
+
+// a path validation in progress, the connection migrates to raddr once the client echoes the challenge from it
+type pathChallenge struct {
+	raddr     *lspnet.UDPAddr
+	conn      *lspnet.UDPConn
+	challenge []byte
+}
+
+type serverShard struct {
+	params            *Params
+	requestc          chan *request
+	deliverc          chan *request
+	closeSignal       chan struct{}
+	networkUtility    *networkUtility
+	readBuffer        map[int]*buffer
+	writeBuffer       map[int]*writeQueue
+	unAckedMsgBuffer  map[int]*buffer
+	latestAckBuffer   map[int]*buffer
+	deferedClose      *list.List
+	hostportConnIdMap map[string]int
+	connIdHostportMap map[int]*lspnet.UDPAddr
+	connIdSocketMap   map[int]*lspnet.UDPConn // local socket each client connected to
+	credential        map[int]uint64
+	pathChallenges    map[int]*pathChallenge
+	activeConn        map[int]bool
+	expectedSeqNum    map[int]int
+	seqNum            map[int]int
+	writeClosed       map[int]bool
+	latestActiveEpoch map[int]int
+	stats             map[int]*ConnStats
+	currEpoch         int
+	connId            int
+	numShards         int
+	shardClosed       bool
+	connLostInClosing bool
+}
+
+// create a new shard with the given index out of numShards shards. conn ids assigned by the shard are
+// index+1, index+1+numShards, index+1+2*numShards... so the shard of a connection can be found from its id.
+// in-order data messages and connection events are handed over via deliverc, the shard exits when closeSignal is closed
+func newServerShard(index, numShards int, params *Params, networkUtility *networkUtility,
+	deliverc chan *request, closeSignal chan struct{}) *serverShard {
+	return &serverShard{
+		params:            params,
+		requestc:          make(chan *request, 100),
+		deliverc:          deliverc,
+		closeSignal:       closeSignal,
+		networkUtility:    networkUtility,
+		readBuffer:        make(map[int]*buffer),
+		writeBuffer:       make(map[int]*writeQueue),
+		unAckedMsgBuffer:  make(map[int]*buffer),
+		latestAckBuffer:   make(map[int]*buffer),
+		deferedClose:      list.New(),
+		hostportConnIdMap: make(map[string]int),
+		connIdHostportMap: make(map[int]*lspnet.UDPAddr),
+		connIdSocketMap:   make(map[int]*lspnet.UDPConn),
+		credential:        make(map[int]uint64),
+		pathChallenges:    make(map[int]*pathChallenge),
+		activeConn:        make(map[int]bool),
+		expectedSeqNum:    make(map[int]int),
+		seqNum:            make(map[int]int),
+		writeClosed:       make(map[int]bool),
+		latestActiveEpoch: make(map[int]int),
+		stats:             make(map[int]*ConnStats),
+		currEpoch:         0,
+		connId:            index + 1 - numShards,
+		numShards:         numShards,
+		shardClosed:       false,
+		connLostInClosing: false,
+	}
+}
+
+// submit the request to reqeust channel (requestc). waiting for the event handler to handle
+func (s *serverShard) doRequest(op int, val interface{}) (interface{}, error) {
+	req := &request{op, val, make(chan *retType)}
+	s.requestc <- req
+	retVal := <-req.replyc
+	return retVal.val, retVal.err
+}
+
+// hand a read result, a datagram or a connection event over to the server, unless the server shuts down
+func (s *serverShard) deliver(op int, val interface{}) {
+	select {
+	case s.deliverc <- &request{op, val, nil}:
+	case <-s.closeSignal:
+	}
+}
+
+// do corresponding actions when a new message comes from network handler
+// return true if the message is kept in the read buffer, otherwise the message can be released
+func (s *serverShard) handleReceivedMsg(req *request) bool {
+	clientAddr := req.val.(*receivedPacket).raddr
+	receivedMsg := req.val.(*receivedPacket).msg
+	if clientConnId := s.hostportConnIdMap[clientAddr.String()]; clientConnId > 0 {
+		s.stats[clientConnId].PacketsReceived += 1
+	} else if receivedMsg.Type != MsgConnect {
+		// the message may come from a client whose address has changed
+		s.handleMigration(req.val.(*receivedPacket))
+		return false
+	}
+	switch receivedMsg.Type {
+	case MsgConnect:
+		// if the hostport was never seen, or the connection is lost/closed, and the server is not closed,
+		// establish a connection and initiate related resources
+		if connId := s.hostportConnIdMap[clientAddr.String()]; s.deferedClose.Len() == 0 && connId == 0 {
+			s.connId += s.numShards
+			s.hostportConnIdMap[clientAddr.String()] = s.connId
+			s.connIdHostportMap[s.connId] = clientAddr
+			s.connIdSocketMap[s.connId] = req.val.(*receivedPacket).conn
+			s.credential[s.connId] = newCredential()
+			s.stats[s.connId] = &ConnStats{PacketsReceived: 1}
+			ackMsg := NewAck(s.connId, 0)
+			ackMsg.Credential = s.credential[s.connId]
+			s.sendMessage(s.connId, ackMsg)
+			s.readBuffer[s.connId] = NewBuffer()
+			s.writeBuffer[s.connId] = newWriteQueue()
+			s.unAckedMsgBuffer[s.connId] = NewBuffer()
+			s.latestAckBuffer[s.connId] = NewBuffer()
+			s.expectedSeqNum[s.connId] = 1
+			s.seqNum[s.connId] = 0
+			s.latestActiveEpoch[s.connId] = s.currEpoch
+			s.activeConn[s.connId] = true
+			s.deliver(deliverevent, &ConnEvent{ConnConnected, s.connId, clientAddr.String()})
+		}
+	case MsgAck:
+		// if the connection with this client is established before, and not lost
+		if clientConnId := s.hostportConnIdMap[clientAddr.String()]; clientConnId > 0 {
+			// set the latest active epoch of the specified connection
+			s.latestActiveEpoch[clientConnId] = s.currEpoch
+
+			unAckedMsgBuffer := s.unAckedMsgBuffer[clientConnId]
+			msgExist := unAckedMsgBuffer.Delete(receivedMsg.SeqNum)
+
+			// move messages from write buffer to unAckedMsg buffer and send them out via network
+			// if their seq nums are in the sliding window
+			if msgExist {
+				s.fillWindow(clientConnId)
+			}
+
+			// if the connection is closed/the server is closed and all pending messages are sent and acked,
+			// clean up all resources that relates to the connection
+			if msgExist && unAckedMsgBuffer.Len() == 0 && (!s.activeConn[clientConnId] || s.deferedClose.Len() > 0) {
+				delete(s.hostportConnIdMap, clientAddr.String())
+				delete(s.connIdHostportMap, clientConnId)
+				delete(s.connIdSocketMap, clientConnId)
+				delete(s.credential, clientConnId)
+				delete(s.pathChallenges, clientConnId)
+				delete(s.stats, clientConnId)
+				delete(s.readBuffer, clientConnId)
+				delete(s.writeBuffer, clientConnId)
+				delete(s.unAckedMsgBuffer, clientConnId)
+				delete(s.latestAckBuffer, clientConnId)
+				delete(s.latestActiveEpoch, clientConnId)
+				delete(s.expectedSeqNum, clientConnId)
+				delete(s.seqNum, clientConnId)
+				delete(s.writeClosed, clientConnId)
+			}
+		}
+	case MsgData, MsgFin:
+		// don't receive data message if the connection is closed/lost or the server is closed
+		if clientConnId := s.hostportConnIdMap[clientAddr.String()]; clientConnId > 0 && s.activeConn[clientConnId] && s.deferedClose.Len() == 0 {
+			// set the latest active epoch of the specified connection
+			s.latestActiveEpoch[clientConnId] = s.currEpoch
+
+			// unreliable datagrams are neither acked nor ordered, just hand them over for reading
+			if receivedMsg.SeqNum == unreliableSeqNum {
+				s.deliver(deliverdatagram, &connIdPayloadBundle{clientConnId, receivedMsg.Payload})
+				return false
+			}
+
+			readBuffer := s.readBuffer[clientConnId]
+
+			// ignore data messages whose seq num is smaller than the expected seq num
+			// epoch handler will resend the acks that haven't been received on the other side (if their seq num is smaller than expected seq num)
+			// and the same size of sliding window on both sending and receiving side guarantee the correctness, otherwise we may have to send ack
+			// for every data message we receive no matter whether its seq num is larger or smaller than the expected seq num.
+			// messages beyond the sliding window can't have been sent by a well-behaved client, they are ignored as well
+			// so that the read buffer never spans more than a window
+			expectedSeqNum := s.expectedSeqNum[clientConnId]
+			if receivedMsg.SeqNum >= expectedSeqNum && receivedMsg.SeqNum < expectedSeqNum+s.params.WindowSize {
+				retained := readBuffer.Insert(receivedMsg)
+				if !retained {
+					s.stats[clientConnId].DuplicatesReceived += 1
+				}
+				// send ack for the data message and put the ack into latestAck buffer
+				latestAckBuffer := s.latestAckBuffer[clientConnId]
+				ackMsg := NewAck(clientConnId, receivedMsg.SeqNum)
+				s.sendMessage(clientConnId, ackMsg)
+
+				latestAckBuffer.Insert(ackMsg)
+				// adjust the buffer to conform sliding window size
+				latestAckBuffer.AdjustUsingWindow(s.params.WindowSize)
+
+				// hand all in-order messages of the connection over for reading, they are not kept any more
+				for readBuffer.Len() > 0 && readBuffer.Front().SeqNum == s.expectedSeqNum[clientConnId] {
+					readMsg := readBuffer.Remove()
+					s.expectedSeqNum[clientConnId] += 1
+					if readMsg.Type == MsgFin {
+						s.deliver(deliverread, &retType{&connIdPayloadBundle{clientConnId, nil}, io.EOF})
+					} else {
+						s.deliver(deliverread, &retType{&connIdPayloadBundle{clientConnId, readMsg.Payload}, nil})
+					}
+					if readMsg == receivedMsg {
+						retained = false
+					} else {
+						releaseMessage(readMsg)
+					}
+				}
+				return retained
+			} else {
+				s.stats[clientConnId].DuplicatesReceived += 1
+			}
+		}
+	}
+	return false
+}
+
+// handle a message with a known conn id coming from an unknown address. a data or ack message carrying the
+// credential of the connection starts a path validation: a probe with a fresh challenge is sent to the new address,
+// and the connection migrates there once the client echoes the challenge back from it. the message itself is
+// dropped, the client resends it after the migration
+func (s *serverShard) handleMigration(packet *receivedPacket) {
+	msg := packet.msg
+	clientAddr := s.connIdHostportMap[msg.ConnID]
+	if clientAddr == nil || msg.Credential != s.credential[msg.ConnID] {
+		return
+	}
+	s.stats[msg.ConnID].PacketsReceived += 1
+	switch msg.Type {
+	case MsgData, MsgAck, MsgFin:
+		// replace any challenge sent before, in case the client moved again or the probe was lost
+		challenge := make([]byte, challengeSize)
+		rand.Read(challenge)
+		s.pathChallenges[msg.ConnID] = &pathChallenge{packet.raddr, packet.conn, challenge}
+		s.networkUtility.sendMessageToAddr(packet.conn, packet.raddr, NewProbe(msg.ConnID, challenge))
+		s.stats[msg.ConnID].PacketsSent += 1
+	case MsgProbe:
+		pending := s.pathChallenges[msg.ConnID]
+		if pending == nil || pending.raddr.String() != packet.raddr.String() || !bytes.Equal(pending.challenge, msg.Payload) {
+			return
+		}
+		delete(s.pathChallenges, msg.ConnID)
+		delete(s.hostportConnIdMap, clientAddr.String())
+		s.hostportConnIdMap[packet.raddr.String()] = msg.ConnID
+		s.connIdHostportMap[msg.ConnID] = packet.raddr
+		s.connIdSocketMap[msg.ConnID] = packet.conn
+		if s.activeConn[msg.ConnID] {
+			s.latestActiveEpoch[msg.ConnID] = s.currEpoch
+			s.deliver(deliverevent, &ConnEvent{ConnMigrated, msg.ConnID, packet.raddr.String()})
+		}
+	}
+}
+
+// return a random non-zero credential for a new connection
+func newCredential() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if credential := binary.BigEndian.Uint64(b[:]); credential != 0 {
+			return credential
+		}
+	}
+}
+
+// do corresponding actions when epoch fires
+func (s *serverShard) handleEpoch() {
+	s.currEpoch += 1
+
+	// detect connection lost
+	for connId, latestActiveEpoch := range s.latestActiveEpoch {
+		if s.currEpoch-latestActiveEpoch >= s.params.EpochLimit {
+			if s.deferedClose.Len() > 0 {
+				s.connLostInClosing = true
+			}
+			delete(s.activeConn, connId)
+			// all in-order messages of the connection are already handed over, so the loss is reported after them
+			s.deliver(deliverevent, &ConnEvent{ConnLost, connId, ""})
+			s.deliver(deliverread, &retType{&connIdPayloadBundle{connId, nil}, errors.New("some connection gets lost")})
+			// clean up all related resources of this connection
+			clientAddr := s.connIdHostportMap[connId]
+			delete(s.hostportConnIdMap, clientAddr.String())
+			delete(s.connIdHostportMap, connId)
+			delete(s.connIdSocketMap, connId)
+			delete(s.credential, connId)
+			delete(s.pathChallenges, connId)
+			delete(s.stats, connId)
+			delete(s.readBuffer, connId)
+			delete(s.writeBuffer, connId)
+			delete(s.unAckedMsgBuffer, connId)
+			delete(s.latestAckBuffer, connId)
+			delete(s.latestActiveEpoch, connId)
+			delete(s.expectedSeqNum, connId)
+			delete(s.seqNum, connId)
+			delete(s.writeClosed, connId)
+		}
+	}
+
+	// don't resend latest ack if the server is closed
+	if s.deferedClose.Len() == 0 {
+		for connId, latestAckBuffer := range s.latestAckBuffer {
+			// if the connection is not closed
+			if s.activeConn[connId] {
+				// if the connection hasn't received any data message after connection is established, send a ack with seq num 0
+				if latestAckBuffer.Len() == 0 {
+					ackMsg := NewAck(connId, 0)
+					s.sendMessage(connId, ackMsg)
+				} else {
+					latestAckMsg := latestAckBuffer.ReturnAll()
+					for _, msg := range latestAckMsg {
+						s.sendMessage(connId, msg)
+					}
+				}
+			}
+		}
+	}
+
+	// resend sent but unacked data messages, even though the connection is closed or the server is closed
+	nonEmptyBuffer := 0
+	for connId, unAckedMsgBuffer := range s.unAckedMsgBuffer {
+		if unAckedMsgBuffer.Len() > 0 || s.writeBuffer[connId].Len() > 0 {
+			nonEmptyBuffer += 1
+		}
+
+		unAckMsg := unAckedMsgBuffer.ReturnAll()
+		for _, msg := range unAckMsg {
+			s.sendMessage(connId, msg)
+		}
+		s.stats[connId].Retransmissions += len(unAckMsg)
+	}
+
+	// if there is deferred Close() request and all pending messages are sent and acked, wake the pending Close request up
+	if s.deferedClose.Len() > 0 && nonEmptyBuffer == 0 {
+		for e := s.deferedClose.Front(); e != nil; e = e.Next() {
+			closeReq := e.Value.(*request)
+			var retVal *retType
+			if s.connLostInClosing {
+				retVal = &retType{nil, errors.New("some connections lost in the cleaning up process")}
+			} else {
+				retVal = &retType{nil, nil}
+			}
+			closeReq.replyc <- retVal
+		}
+		s.shardClosed = true
+	}
+}
+
+// handle user write request
+func (s *serverShard) handleWrite(req *request) {
+	bundle := req.val.(*priorityPayloadBundle)
+	connId := bundle.connId
+	// return an error if the connection is closed/lost, or the server is closed
+	if s.deferedClose.Len() > 0 || !s.activeConn[connId] {
+		req.replyc <- &retType{nil, errors.New("server/connection closed or connection lost")}
+	} else if s.writeClosed[connId] {
+		req.replyc <- &retType{nil, errors.New("write side closed")}
+	} else {
+		// if the conn id exists
+		if clientAddr := s.connIdHostportMap[connId]; clientAddr != nil {
+			s.writeBuffer[connId].Push(NewData(connId, 0, bundle.payload), bundle.priority)
+			s.fillWindow(connId)
+			req.replyc <- &retType{nil, nil}
+		} else {
+			req.replyc <- &retType{nil, errors.New("connection doesn't exist")}
+		}
+	}
+}
+
+// handle user close write request of a specified connection, an end of stream message is sent after all written messages
+func (s *serverShard) handleCloseWrite(req *request) {
+	connId := req.val.(int)
+	if s.deferedClose.Len() > 0 || !s.activeConn[connId] {
+		req.replyc <- &retType{nil, errors.New("server/connection closed or connection lost")}
+	} else if s.writeClosed[connId] {
+		req.replyc <- &retType{nil, errors.New("write side already closed")}
+	} else {
+		s.writeClosed[connId] = true
+		s.writeBuffer[connId].Push(NewFin(connId, 0), PriorityNormal)
+		s.fillWindow(connId)
+		req.replyc <- &retType{nil, nil}
+	}
+}
+
+// move messages from the write buffer of the connection into its unAckedMsg buffer and send them out via network
+// as long as the next seq num is in the sliding window. messages get their seq nums here, in order of priority
+func (s *serverShard) fillWindow(connId int) {
+	unAckedMsgBuffer := s.unAckedMsgBuffer[connId]
+	writeBuffer := s.writeBuffer[connId]
+	for writeBuffer.Len() > 0 &&
+		(unAckedMsgBuffer.Len() == 0 || s.seqNum[connId]+1-s.params.WindowSize < unAckedMsgBuffer.Front().SeqNum) {
+		s.seqNum[connId] += 1
+		sentMsg := writeBuffer.Pop()
+		sentMsg.SeqNum = s.seqNum[connId]
+		unAckedMsgBuffer.Insert(sentMsg)
+		s.sendMessage(connId, sentMsg)
+	}
+}
+
+// handle user unreliable write request, the message is sent out immediately and never buffered
+func (s *serverShard) handleWriteUnreliable(req *request) {
+	connId := req.val.(*connIdPayloadBundle).connId
+	payload := req.val.(*connIdPayloadBundle).payload
+	// return an error if the connection is closed/lost, or the server is closed
+	if s.deferedClose.Len() > 0 || !s.activeConn[connId] {
+		req.replyc <- &retType{nil, errors.New("server/connection closed or connection lost")}
+		return
+	}
+	if s.writeClosed[connId] {
+		req.replyc <- &retType{nil, errors.New("write side closed")}
+		return
+	}
+
+	s.sendMessage(connId, NewData(connId, unreliableSeqNum, payload))
+	req.replyc <- &retType{nil, nil}
+}
+
+// handle user get stats request of a specified connection
+func (s *serverShard) handleStats(req *request) {
+	connId := req.val.(int)
+	connStats := s.stats[connId]
+	if connStats == nil {
+		req.replyc <- &retType{nil, errors.New("connection ID doesn't exist")}
+		return
+	}
+
+	// copy the counters so the caller gets a consistent snapshot
+	stats := *connStats
+	if unAckedMsgBuffer := s.unAckedMsgBuffer[connId]; unAckedMsgBuffer != nil {
+		stats.UnAckedMsgs = unAckedMsgBuffer.Len()
+	}
+	if writeBuffer := s.writeBuffer[connId]; writeBuffer != nil {
+		stats.PendingWrites = writeBuffer.Len()
+	}
+	if latestActiveEpoch, ok := s.latestActiveEpoch[connId]; ok {
+		stats.IdleEpochs = s.currEpoch - latestActiveEpoch
+	}
+	req.replyc <- &retType{&stats, nil}
+}
+
+// handle user close a specified connection
+func (s *serverShard) handleCloseConn(req *request) {
+	connId := req.val.(int)
+	// if the connection is not closed or lost
+	if s.activeConn[connId] {
+		// let a Read return an error for the closed connection
+		s.deliver(deliverevent, &ConnEvent{ConnClosed, connId, ""})
+		s.deliver(deliverread, &retType{&connIdPayloadBundle{connId, nil}, errors.New("some connection gets closed explicitly")})
+
+		clientAddr := s.connIdHostportMap[connId]
+		// if there is no pending messages to be resent and acked, clean up resources that are used for resending unAcked messages
+		if s.unAckedMsgBuffer[connId].Len() == 0 && s.writeBuffer[connId].Len() == 0 {
+			delete(s.writeBuffer, connId)
+			delete(s.unAckedMsgBuffer, connId)
+			delete(s.hostportConnIdMap, clientAddr.String())
+			delete(s.connIdHostportMap, connId)
+			delete(s.connIdSocketMap, connId)
+			delete(s.credential, connId)
+			delete(s.pathChallenges, connId)
+			delete(s.stats, connId)
+		}
+
+		delete(s.readBuffer, connId)
+		delete(s.latestAckBuffer, connId)
+		delete(s.latestActiveEpoch, connId)
+		delete(s.expectedSeqNum, connId)
+		delete(s.seqNum, connId)
+		delete(s.writeClosed, connId)
+
+		delete(s.activeConn, connId)
+		req.replyc <- &retType{nil, nil}
+	} else {
+		req.replyc <- &retType{nil, errors.New("connection ID doesn't exist")}
+	}
+}
+
+// handle server close, the shard stops accepting new connections and data messages,
+// and replies once all pending messages of its connections are sent and acked
+func (s *serverShard) handleClose(req *request) {
+	nonEmptyBuffer := 0
+	for connId, unAckedMsgBuffer := range s.unAckedMsgBuffer {
+		if unAckedMsgBuffer.Len() > 0 || s.writeBuffer[connId].Len() > 0 {
+			nonEmptyBuffer += 1
+			break
+		}
+	}
+	// if there is no sent but unacked messages, the shard is closed immediately
+	if nonEmptyBuffer == 0 {
+		req.replyc <- &retType{nil, nil}
+		s.shardClosed = true
+	} else {
+		// otherwise defer the Close request
+		s.deferedClose.PushBack(req)
+	}
+}
+
+// send message to the client with specified conn id and count it in the connection stats
+func (s *serverShard) sendMessage(connId int, msg *Message) {
+	s.networkUtility.sendMessageToAddr(s.connIdSocketMap[connId], s.connIdHostportMap[connId], msg)
+	s.stats[connId].PacketsSent += 1
+}
+
+// go routine which handles multiple requests (notification) from reqeust channel (requestc),
+// including reqeusts from user and notifications from epoch timer and network handler.
+// once the shard is closed it ignores notifications and rejects user requests until the server shuts down
+func (s *serverShard) eventHandler() {
+	for {
+		var req *request
+		select {
+		case req = <-s.requestc:
+		case <-s.closeSignal:
+			return
+		}
+
+		if s.shardClosed {
+			if req.op == receivemsg {
+				releaseMessage(req.val.(*receivedPacket).msg)
+				releasePacket(req)
+			} else if req.op == epochtimer {
+				releaseEpoch(req)
+			} else {
+				req.replyc <- &retType{nil, errors.New("server is closed")}
+			}
+			continue
+		}
+
+		switch req.op {
+		case receivemsg:
+			if !s.handleReceivedMsg(req) {
+				releaseMessage(req.val.(*receivedPacket).msg)
+			}
+			releasePacket(req)
+		case epochtimer:
+			s.handleEpoch()
+			releaseEpoch(req)
+		case dowrite:
+			s.handleWrite(req)
+		case dowriteunreliable:
+			s.handleWriteUnreliable(req)
+		case doclosewrite:
+			s.handleCloseWrite(req)
+		case dostats:
+			s.handleStats(req)
+		case docloseconn:
+			s.handleCloseConn(req)
+		case doclose:
+			s.handleClose(req)
+		}
+	}
+}
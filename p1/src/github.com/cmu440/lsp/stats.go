@@ -0,0 +1,38 @@
+// Contains the per-connection statistics reported by Client.Stats and Server.Stats
+
+package lsp
+
+import "fmt"
+
+// ConnStats is a snapshot of the traffic and buffer state of a single LSP connection.
+type ConnStats struct {
+	// PacketsSent is the number of packets (connect, data and ack) sent on the connection.
+	PacketsSent int
+
+	// PacketsReceived is the number of packets received on the connection.
+	PacketsReceived int
+
+	// Retransmissions is the number of data messages resent because they were not
+	// acknowledged before an epoch fired.
+	Retransmissions int
+
+	// DuplicatesReceived is the number of data messages received more than once.
+	DuplicatesReceived int
+
+	// UnAckedMsgs is the number of sent but unacknowledged messages, i.e. the current
+	// occupancy of the sliding window.
+	UnAckedMsgs int
+
+	// PendingWrites is the number of written messages waiting for room in the sliding window.
+	PendingWrites int
+
+	// IdleEpochs is the number of epochs since a message was last received on the connection.
+	IdleEpochs int
+}
+
+// String returns a string representation of this stats.
+func (cs *ConnStats) String() string {
+	return fmt.Sprintf("[Sent: %d, Received: %d, Retransmissions: %d, Duplicates: %d, UnAcked: %d, PendingWrites: %d, IdleEpochs: %d]",
+		cs.PacketsSent, cs.PacketsReceived, cs.Retransmissions, cs.DuplicatesReceived,
+		cs.UnAckedMsgs, cs.PendingWrites, cs.IdleEpochs)
+}
@@ -0,0 +1,66 @@
+// Contains the priority classes of written messages, and the write queue which keeps written messages
+// waiting for room in the sliding window. messages get their seq nums only when they leave the queue,
+// so an urgent message overtakes the normal messages written before it on the wire as well
+
+package lsp
+
+import "container/list"
+
+// Priority is the class of a message written with WriteWithPriority. Messages of a
+// higher class are sent before pending messages of lower classes, while messages of
+// the same class are always sent and read in the order they are written.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota // The class of messages written with Write.
+	PriorityUrgent                 // Jumps ahead of all pending normal messages.
+	numPriorities
+)
+
+// struct which bundles connId, payLoad and priority, this is used for passing the parameters of
+// WriteWithPriority() function to event handler. connId is not used on client side
+type priorityPayloadBundle struct {
+	connId   int
+	payload  []byte
+	priority Priority
+}
+
+type writeQueue struct {
+	classes [numPriorities]*list.List // one FIFO of messages per priority class
+	count   int                       // number of messages in all classes
+}
+
+func newWriteQueue() *writeQueue {
+	q := &writeQueue{}
+	for i := range q.classes {
+		q.classes[i] = list.New()
+	}
+	return q
+}
+
+// return true if the given priority is a valid priority class
+func validPriority(priority Priority) bool {
+	return priority >= 0 && priority < numPriorities
+}
+
+// append a message to the end of the given priority class
+func (q *writeQueue) Push(msg *Message, priority Priority) {
+	q.classes[priority].PushBack(msg)
+	q.count += 1
+}
+
+// remove the first message of the highest non-empty priority class
+func (q *writeQueue) Pop() *Message {
+	for i := len(q.classes) - 1; i >= 0; i-- {
+		if front := q.classes[i].Front(); front != nil {
+			q.count -= 1
+			return q.classes[i].Remove(front).(*Message)
+		}
+	}
+	return nil
+}
+
+// return number of messages in the queue
+func (q *writeQueue) Len() int {
+	return q.count
+}
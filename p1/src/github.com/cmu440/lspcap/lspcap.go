@@ -0,0 +1,271 @@
+// Decoder and replayer of the packet captures recorded by lspnet.StartCapture.
+//
+// By default the datagrams of the capture are printed one per line, decoded as
+// LSP messages. With -replay, the datagrams the clients of the capture sent to
+// its server are sent again, with their original timing, to the live server at
+// the given address, one socket per captured client, and the replies of the
+// live server are printed. Connection IDs and credentials are rewritten to the
+// ones handed out by the live server.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+var (
+	replayAddr = flag.String("replay", "", "address of the live server to replay the capture against")
+	serverAddr = flag.String("server", "", "address of the captured server (default: where the first connect message was sent)")
+	speed      = flag.Float64("speed", 1, "replay speed relative to the capture, 0 to replay as fast as possible")
+	wait       = flag.Duration("wait", time.Second, "time to wait for replies after the last replayed datagram")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] capture-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	records, err := readCapture(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("Failed to read capture %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	if *replayAddr == "" {
+		printCapture(records)
+		return
+	}
+	if err := replay(records); err != nil {
+		fmt.Printf("Failed to replay capture: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func readCapture(path string) ([]*lspnet.CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr, err := lspnet.NewCaptureReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var records []*lspnet.CaptureRecord
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// decode a datagram as an LSP message, nil if it isn't one
+func decode(payload []byte) *lsp.Message {
+	var msg lsp.Message
+	if json.Unmarshal(payload, &msg) != nil {
+		return nil
+	}
+	return &msg
+}
+
+func describe(payload []byte) string {
+	if msg := decode(payload); msg != nil {
+		return msg.String()
+	}
+	return fmt.Sprintf("undecodable %q", payload)
+}
+
+func printCapture(records []*lspnet.CaptureRecord) {
+	for _, rec := range records {
+		offset := rec.Time.Sub(records[0].Time).Seconds()
+		if rec.Sent {
+			fmt.Printf("%+.6fs sent %s -> %s %s\n", offset, rec.Local, rec.Remote, describe(rec.Payload))
+		} else {
+			fmt.Printf("%+.6fs recv %s <- %s %s\n", offset, rec.Local, rec.Remote, describe(rec.Payload))
+		}
+	}
+}
+
+// port of a host:port address, -1 if it has none
+func port(addr string) int {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return -1
+	}
+	p, err := strconv.Atoi(portStr)
+	if err != nil {
+		return -1
+	}
+	return p
+}
+
+// clientPacket is a datagram a captured client sent to the captured server.
+type clientPacket struct {
+	rec    *lspnet.CaptureRecord
+	client string // address of the client
+}
+
+// pick the datagrams the clients sent to the server, as recorded by the clients if
+// the capture has them, otherwise as recorded by the server
+func clientPackets(records []*lspnet.CaptureRecord, server string) []clientPacket {
+	serverPort := port(server)
+	var sent, received []clientPacket
+	for _, rec := range records {
+		if rec.Sent && port(rec.Remote) == serverPort {
+			sent = append(sent, clientPacket{rec, rec.Local})
+		} else if !rec.Sent && port(rec.Local) == serverPort {
+			received = append(received, clientPacket{rec, rec.Remote})
+		}
+	}
+	if len(sent) > 0 {
+		return sent
+	}
+	return received
+}
+
+// where the first connect message of the capture was sent
+func findServer(records []*lspnet.CaptureRecord) string {
+	for _, rec := range records {
+		if msg := decode(rec.Payload); msg != nil && msg.Type == lsp.MsgConnect {
+			if rec.Sent {
+				return rec.Remote
+			}
+			return rec.Local
+		}
+	}
+	return ""
+}
+
+// replayClient is the socket replaying the datagrams of one captured client.
+type replayClient struct {
+	name       string
+	conn       *lspnet.UDPConn
+	mutex      sync.Mutex
+	connID     int
+	credential uint64
+	connected  chan struct{} // closed once the live server acks the connect message
+	numSent    int
+	numRecv    int
+}
+
+func newReplayClient(name string, raddr *lspnet.UDPAddr) (*replayClient, error) {
+	conn, err := lspnet.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &replayClient{name: name, conn: conn, connected: make(chan struct{})}
+	go c.receive()
+	return c, nil
+}
+
+// print the replies of the live server, and learn the connection ID it hands out
+func (c *replayClient) receive() {
+	buf := make([]byte, 2000)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		msg := decode(buf[:n])
+		fmt.Printf("client %s received %s\n", c.name, describe(buf[:n]))
+		c.mutex.Lock()
+		c.numRecv += 1
+		if msg != nil && msg.Type == lsp.MsgAck && msg.SeqNum == 0 && c.connID == 0 {
+			c.connID = msg.ConnID
+			c.credential = msg.Credential
+			close(c.connected)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// send a captured datagram, rewritten to the connection the live server handed out
+func (c *replayClient) send(payload []byte) error {
+	if msg := decode(payload); msg != nil && msg.Type != lsp.MsgConnect {
+		select {
+		case <-c.connected:
+		case <-time.After(*wait):
+			return fmt.Errorf("client %s not connected to the live server", c.name)
+		}
+		c.mutex.Lock()
+		msg.ConnID, msg.Credential = c.connID, c.credential
+		c.mutex.Unlock()
+		payload, _ = json.Marshal(msg)
+	}
+	fmt.Printf("client %s sent %s\n", c.name, describe(payload))
+	c.mutex.Lock()
+	c.numSent += 1
+	c.mutex.Unlock()
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+func replay(records []*lspnet.CaptureRecord) error {
+	server := *serverAddr
+	if server == "" {
+		if server = findServer(records); server == "" {
+			return fmt.Errorf("no connect message in the capture, use -server")
+		}
+	}
+	packets := clientPackets(records, server)
+	if len(packets) == 0 {
+		return fmt.Errorf("no datagram sent to server %s in the capture", server)
+	}
+	raddr, err := lspnet.ResolveUDPAddr("udp", *replayAddr)
+	if err != nil {
+		return err
+	}
+
+	clients := make(map[string]*replayClient)
+	var order []*replayClient
+	defer func() {
+		for _, c := range order {
+			c.conn.Close()
+		}
+	}()
+	start := time.Now()
+	for _, packet := range packets {
+		if *speed > 0 {
+			due := time.Duration(float64(packet.rec.Time.Sub(packets[0].rec.Time)) / *speed)
+			time.Sleep(time.Until(start.Add(due)))
+		}
+		c := clients[packet.client]
+		if c == nil {
+			if c, err = newReplayClient(packet.client, raddr); err != nil {
+				return err
+			}
+			clients[packet.client] = c
+			order = append(order, c)
+		}
+		if err := c.send(packet.rec.Payload); err != nil {
+			return err
+		}
+	}
+	time.Sleep(*wait)
+
+	for _, c := range order {
+		c.mutex.Lock()
+		fmt.Printf("client %s: connection %d, sent %d, received %d\n", c.name, c.connID, c.numSent, c.numRecv)
+		c.mutex.Unlock()
+	}
+	return nil
+}
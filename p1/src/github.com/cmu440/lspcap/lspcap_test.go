@@ -0,0 +1,127 @@
+// lspcap tests.
+
+// These tests capture an LSP session on the simulated network of lspnet and
+// replay it against a new server, which must read the same payloads, sent on
+// the connection with the ID it handed out itself.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// read a data message from a server, failing the test if none arrives in time
+func readServer(t *testing.T, srv lsp.Server) (int, string) {
+	type result struct {
+		connID  int
+		payload []byte
+		err     error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		connID, payload, err := srv.Read()
+		resc <- result{connID, payload, err}
+	}()
+	select {
+	case res := <-resc:
+		if res.err != nil {
+			t.Fatalf("Server Read failed: %s", res.err)
+		}
+		return res.connID, string(res.payload)
+	case <-time.After(time.Second):
+		t.Fatalf("Server read nothing")
+	}
+	return 0, ""
+}
+
+func TestReplay(t *testing.T) {
+	lspnet.EnableSimulation(1)
+	defer lspnet.DisableSimulation()
+	params := &lsp.Params{EpochLimit: 5, EpochMillis: 1000, WindowSize: 1}
+	payloads := []string{"first", "second", "third"}
+
+	// capture a client writing to a server
+	path := filepath.Join(t.TempDir(), "session.cap")
+	if err := lspnet.StartCaptureFile(path); err != nil {
+		t.Fatalf("StartCaptureFile failed: %s", err)
+	}
+	capturedSrv, err := lsp.NewServer(9998, params)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer capturedSrv.Close()
+	cli, err := lsp.NewClient("127.0.0.1:9998", params)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer cli.Close()
+	for _, payload := range payloads {
+		cli.Write([]byte(payload))
+		if _, got := readServer(t, capturedSrv); got != payload {
+			t.Fatalf("Captured server read %q, expected %q", got, payload)
+		}
+	}
+	if err := lspnet.StopCapture(); err != nil {
+		t.Fatalf("StopCapture failed: %s", err)
+	}
+	records, err := readCapture(path)
+	if err != nil {
+		t.Fatalf("Failed to read capture: %s", err)
+	}
+
+	liveSrv, err := lsp.NewServer(9999, params)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer liveSrv.Close()
+
+	// the replay is captured as well, to check the datagrams sent to the live server
+	replayPath := filepath.Join(t.TempDir(), "replay.cap")
+	if err := lspnet.StartCaptureFile(replayPath); err != nil {
+		t.Fatalf("StartCaptureFile failed: %s", err)
+	}
+	*replayAddr, *speed, *wait = "127.0.0.1:9999", 0, 100*time.Millisecond
+	if err := replay(records); err != nil {
+		t.Fatalf("Replay failed: %s", err)
+	}
+	if err := lspnet.StopCapture(); err != nil {
+		t.Fatalf("StopCapture failed: %s", err)
+	}
+	replayed, err := readCapture(replayPath)
+	if err != nil {
+		t.Fatalf("Failed to read capture of the replay: %s", err)
+	}
+
+	// the live server hands out its own connection ID and credential in the ack of the connect message,
+	// every replayed datagram after it must carry them instead of the captured ones
+	var live *lsp.Message
+	for _, rec := range replayed {
+		msg := decode(rec.Payload)
+		if msg == nil || msg.Type == lsp.MsgConnect {
+			continue
+		}
+		if !rec.Sent && live == nil && msg.Type == lsp.MsgAck && msg.SeqNum == 0 {
+			live = msg
+		} else if rec.Sent && port(rec.Remote) == 9999 {
+			if live == nil || msg.ConnID != live.ConnID || msg.Credential != live.Credential {
+				t.Fatalf("Replayed %s with credential %d, expected the live connection and credential of %v",
+					msg, msg.Credential, live)
+			}
+		}
+	}
+	if live == nil {
+		t.Fatalf("Live server did not ack the replayed connect message")
+	}
+	for _, payload := range payloads {
+		connID, got := readServer(t, liveSrv)
+		if got != payload || connID != live.ConnID {
+			t.Fatalf("Live server read %q from connection %d, expected %q from connection %d",
+				got, connID, payload, live.ConnID)
+		}
+	}
+}
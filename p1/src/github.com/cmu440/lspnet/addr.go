@@ -5,10 +5,15 @@ import "net"
 // UDPAddr is a wrapper around net.UDPAddr.
 type UDPAddr struct {
 	naddr *net.UDPAddr
+	str   string // naddr.String(), computed once since addresses are used as map keys on every packet
 }
 
-func (a *UDPAddr) String() string { return a.naddr.String() }
+func newUDPAddr(naddr *net.UDPAddr) *UDPAddr {
+	return &UDPAddr{naddr: naddr, str: naddr.String()}
+}
+
+func (a *UDPAddr) String() string { return a.str }
 
 func (a *UDPAddr) toNet() *net.UDPAddr {
-	return &net.UDPAddr{a.naddr.IP, a.naddr.Port, a.naddr.Zone}
+	return &net.UDPAddr{IP: a.naddr.IP, Port: a.naddr.Port, Zone: a.naddr.Zone}
 }
@@ -0,0 +1,196 @@
+package lspnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Magic bytes at the start of a capture file, including the version of the format.
+const captureMagic = "LSPCAP\x00\x01"
+
+// CaptureRecord is a datagram sent or received through lspnet, as recorded by a capture.
+type CaptureRecord struct {
+	Time    time.Time // when the datagram was written or read, on the virtual clock for simulated sockets
+	Sent    bool      // true if the datagram was written by the local socket, false if it was read
+	Local   string    // address of the local socket
+	Remote  string    // address the datagram was sent to or received from
+	Payload []byte
+}
+
+var (
+	captureWriter io.Writer
+	captureCloser io.Closer // the file opened by StartCaptureFile, nil otherwise
+	captureErr    error     // the first error writing the capture
+	capturing     uint32    // 1 while a capture is running, read without the lock on every datagram
+	captureMutex  sync.Mutex
+)
+
+// StartCapture records every datagram written by and read through lspnet to w,
+// until StopCapture is called. Datagrams dropped on write are recorded as sent,
+// and datagrams dropped on read are not recorded. Each record is written to w
+// with a single Write call. A running capture is stopped first.
+func StartCapture(w io.Writer) error {
+	StopCapture()
+	if _, err := io.WriteString(w, captureMagic); err != nil {
+		return err
+	}
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+	captureWriter = w
+	captureErr = nil
+	atomic.StoreUint32(&capturing, 1)
+	return nil
+}
+
+// StartCaptureFile behaves the same as StartCapture, recording to a newly created
+// file at path which is closed by StopCapture.
+func StartCaptureFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := StartCapture(f); err != nil {
+		f.Close()
+		return err
+	}
+	captureMutex.Lock()
+	captureCloser = f
+	captureMutex.Unlock()
+	return nil
+}
+
+// StopCapture stops the running capture, if any. It returns the first error met
+// while writing the capture or closing its file.
+func StopCapture() error {
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+	atomic.StoreUint32(&capturing, 0)
+	err := captureErr
+	if captureCloser != nil {
+		if closeErr := captureCloser.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	captureWriter, captureCloser, captureErr = nil, nil, nil
+	return err
+}
+
+// record a datagram written or read by a socket, if a capture is running
+func captureDatagram(now time.Time, sent bool, local, remote string, payload []byte) {
+	if atomic.LoadUint32(&capturing) == 0 {
+		return
+	}
+	buf := make([]byte, 0, 8+1+2+len(local)+2+len(remote)+4+len(payload))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(now.UnixNano()))
+	if sent {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(local)))
+	buf = append(buf, local...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(remote)))
+	buf = append(buf, remote...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+	if captureWriter == nil || captureErr != nil {
+		return
+	}
+	if _, err := captureWriter.Write(buf); err != nil {
+		captureErr = err
+	}
+}
+
+// capture records a datagram written or read by c, remote is nil for the peer of a dialed connection.
+func (c *UDPConn) capture(sent bool, remote *UDPAddr, payload []byte) {
+	if atomic.LoadUint32(&capturing) == 0 {
+		return
+	}
+	if c.sim != nil {
+		raddr := netip.AddrPortFrom(c.endpoint.addr.Addr(), uint16(c.peerPort)).String()
+		if remote != nil {
+			raddr = remote.String()
+		}
+		captureDatagram(c.sim.clock.Now(), sent, c.endpoint.addr.String(), raddr, payload)
+		return
+	}
+	raddr := ""
+	if remote != nil {
+		raddr = remote.String()
+	} else if addr := c.nconn.RemoteAddr(); addr != nil {
+		raddr = addr.String()
+	}
+	captureDatagram(time.Now(), sent, c.nconn.LocalAddr().String(), raddr, payload)
+}
+
+// CaptureReader reads the records of a capture in the order they were recorded.
+type CaptureReader struct {
+	r io.Reader
+}
+
+// NewCaptureReader returns a reader of the capture in r. It returns a non-nil error
+// if r doesn't start with a capture header.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		return nil, errors.New("not an lspnet capture")
+	}
+	return &CaptureReader{r}, nil
+}
+
+// Next returns the next record of the capture, or io.EOF after the last one.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+		return nil, err
+	}
+	rec := &CaptureRecord{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+		Sent: header[8] == 1,
+	}
+	var err error
+	if rec.Local, err = cr.readString(); err != nil {
+		return nil, err
+	}
+	if rec.Remote, err = cr.readString(); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(cr.r, size[:]); err != nil {
+		return nil, truncated(err)
+	}
+	rec.Payload = make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(cr.r, rec.Payload); err != nil {
+		return nil, truncated(err)
+	}
+	return rec, nil
+}
+
+func (cr *CaptureReader) readString() (string, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(cr.r, size[:]); err != nil {
+		return "", truncated(err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return "", truncated(err)
+	}
+	return string(buf), nil
+}
+
+// a capture ending in the middle of a record is cut short, not complete
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
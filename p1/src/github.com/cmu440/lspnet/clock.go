@@ -0,0 +1,205 @@
+package lspnet
+
+import (
+	"sync"
+	"time"
+)
+
+// Ticker behaves the same as time.Ticker, except that it is driven by the virtual
+// clock when the simulated network is enabled (see EnableSimulation).
+type Ticker struct {
+	C <-chan time.Time // The channel on which the ticks are delivered.
+
+	c          chan time.Time
+	timeTicker *time.Ticker
+	clock      *virtualClock
+	period     time.Duration
+	next       time.Time // time of the next tick on the virtual clock
+	stopc      chan struct{}
+	pending    int // ticks sent but not handled yet, guarded by clock.work.mutex
+}
+
+// virtualClock is the clock of the simulated network. It stands still until
+// AdvanceClock is called, which fires the ticks of all tickers and the timers
+// (e.g. delayed packets) due in between.
+type virtualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*Ticker      // in creation order, which breaks ties between ticks due at the same time
+	timers  []virtualTimer // in creation order as well
+	work    pendingWork
+}
+
+type virtualTimer struct {
+	due time.Time
+	f   func()
+}
+
+// pendingWork counts the work the simulated network has handed to its users and which
+// they have not handled yet: packets waiting in the inbox of a socket or read from it,
+// and ticks sent on a ticker. The work of a socket or ticker is counted by itself as
+// well, so that it is no longer waited for once the socket is closed or the ticker stopped.
+type pendingWork struct {
+	mutex sync.Mutex
+	idle  *sync.Cond // signalled when total drops to 0
+	total int
+}
+
+// add delta to the work pending on a socket or ticker, whose own count is *pending
+func (w *pendingWork) add(pending *int, delta int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if *pending+delta < 0 {
+		// more work handled than handed out, e.g. after the socket or ticker was closed
+		delta = -*pending
+	}
+	w.update(pending, delta)
+}
+
+// stop waiting for the work pending on a socket or ticker, whose own count is *pending
+func (w *pendingWork) clear(pending *int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.update(pending, -*pending)
+}
+
+// must be called with the mutex held
+func (w *pendingWork) update(pending *int, delta int) {
+	*pending += delta
+	w.total += delta
+	if w.total == 0 && w.idle != nil {
+		w.idle.Broadcast()
+	}
+}
+
+// wait until all work handed out has been handled
+func (w *pendingWork) wait() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.idle == nil {
+		w.idle = sync.NewCond(&w.mutex)
+	}
+	for w.total > 0 {
+		w.idle.Wait()
+	}
+}
+
+// Now returns the current time of the virtual clock.
+func (clock *virtualClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+// afterFunc calls f once the virtual clock has moved d forward. f is called from AdvanceClock.
+func (clock *virtualClock) afterFunc(d time.Duration, f func()) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.timers = append(clock.timers, virtualTimer{clock.now.Add(d), f})
+}
+
+// NewTicker behaves the same as the time.NewTicker function.
+func NewTicker(d time.Duration) *Ticker {
+	sim := currentSim()
+	if sim == nil {
+		timeTicker := time.NewTicker(d)
+		return &Ticker{C: timeTicker.C, timeTicker: timeTicker}
+	}
+	clock := sim.clock
+	c := make(chan time.Time)
+	t := &Ticker{C: c, c: c, clock: clock, period: d, stopc: make(chan struct{})}
+	clock.mutex.Lock()
+	t.next = clock.now.Add(d)
+	clock.tickers = append(clock.tickers, t)
+	clock.mutex.Unlock()
+	return t
+}
+
+// Stop turns off a ticker. After Stop, no more ticks will be sent.
+func (t *Ticker) Stop() {
+	if t.timeTicker != nil {
+		t.timeTicker.Stop()
+		return
+	}
+	t.clock.mutex.Lock()
+	for i, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			close(t.stopc)
+			break
+		}
+	}
+	t.clock.mutex.Unlock()
+	// ticks nobody is going to handle any more are not waited for
+	t.clock.work.clear(&t.pending)
+}
+
+// Handled tells the virtual clock that the work caused by a tick received from
+// the ticker is done. When the simulated network is enabled, every tick must be
+// handled, or AdvanceClock waits for it forever (until the ticker is stopped).
+func (t *Ticker) Handled() {
+	if t.clock != nil {
+		t.clock.work.add(&t.pending, -1)
+	}
+}
+
+// AdvanceClock moves the virtual clock of the simulated network forward by d.
+// The ticks of all tickers and the delayed packets due in between are sent one
+// at a time, in the order they are due. Before each of them, and before it
+// returns, AdvanceClock waits until the network is quiescent: every packet sent
+// so far has been read and handled (see UDPConn.Handled), and every tick sent so
+// far has been received and handled (see Ticker.Handled). So AdvanceClock(0)
+// just waits for the replies to the packets sent before to settle. Packets due at
+// the same time as a tick arrive first. It has no effect unless the simulated
+// network is enabled.
+func AdvanceClock(d time.Duration) {
+	sim := currentSim()
+	if sim == nil {
+		return
+	}
+	clock := sim.clock
+	clock.mutex.Lock()
+	target := clock.now.Add(d)
+	for {
+		dueTimer := -1
+		for i, timer := range clock.timers {
+			if !timer.due.After(target) && (dueTimer < 0 || timer.due.Before(clock.timers[dueTimer].due)) {
+				dueTimer = i
+			}
+		}
+		var due *Ticker
+		for _, t := range clock.tickers {
+			if !t.next.After(target) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if dueTimer >= 0 && (due == nil || !due.next.Before(clock.timers[dueTimer].due)) {
+			timer := clock.timers[dueTimer]
+			clock.timers = append(clock.timers[:dueTimer], clock.timers[dueTimer+1:]...)
+			clock.now = timer.due
+			clock.mutex.Unlock()
+			clock.work.wait()
+			timer.f()
+			clock.mutex.Lock()
+			continue
+		}
+		if due == nil {
+			clock.now = target
+			clock.mutex.Unlock()
+			clock.work.wait()
+			return
+		}
+		clock.now = due.next
+		due.next = due.next.Add(due.period)
+		now := clock.now
+		clock.mutex.Unlock()
+		clock.work.wait()
+		clock.work.add(&due.pending, 1)
+		select {
+		case due.c <- now:
+		case <-due.stopc:
+			clock.work.add(&due.pending, -1)
+		}
+		clock.mutex.Lock()
+	}
+}
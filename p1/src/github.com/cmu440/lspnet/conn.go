@@ -5,9 +5,15 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"net/netip"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// max number of remote addresses remembered per connection by ReadFromUDP
+const maxCachedAddrs = 4096
+
 var enableDebugLogs uint32
 
 // EnableDebugLogs has log messages directed to standard output if enable is true.
@@ -27,44 +33,89 @@ func isLoggingEnabled() bool {
 // proxied directly to the corresponding methods in the net.UDPConn packge, but provide
 // some additional book-keeping that is necessary for testing the students' code.
 type UDPConn struct {
-	nconn *net.UDPConn
+	nconn     *net.UDPConn
+	addrMutex sync.Mutex
+	addrCache map[netip.AddrPort]*UDPAddr
+	linkMutex sync.Mutex
+	links     map[string]*impairedLink // impairments by remote address, "" for a dialed connection
+
+	// Set instead of nconn for connections on the simulated network.
+	sim      *simNetwork
+	endpoint *simEndpoint
+	peerPort int // port of the remote address of a dialed connection
+}
+
+func newUDPConn(nconn *net.UDPConn) *UDPConn {
+	return &UDPConn{nconn: nconn, addrCache: make(map[netip.AddrPort]*UDPAddr)}
+}
+
+// newSimUDPConn opens a connection on the simulated network, on a free port if port is 0.
+// peerPort is the port written to by Write, 0 unless the connection is dialed.
+func newSimUDPConn(sim *simNetwork, port, peerPort int) (*UDPConn, error) {
+	conn := &UDPConn{addrCache: make(map[netip.AddrPort]*UDPAddr), sim: sim, peerPort: peerPort}
+	endpoint, err := sim.open(conn, port)
+	if err != nil {
+		return nil, err
+	}
+	conn.endpoint = endpoint
+	return conn, nil
 }
 
 // Read implements the Conn Read method.
 func (c *UDPConn) Read(b []byte) (n int, err error) {
+	if c.sim != nil {
+		n, _, err = c.endpoint.read(b)
+		if err == nil {
+			c.capture(false, nil, b[:n])
+		}
+		return n, err
+	}
 	var dropPercent = readDropPercent(c)
-	var buffer [2000]byte
 	for {
-		n, err = c.nconn.Read(buffer[0:])
+		n, err = c.nconn.Read(b)
 		if dropIt(dropPercent) {
 			if isLoggingEnabled() {
 				log.Printf("DROPPING read packet of length %d\n", n)
 			}
 		} else {
-			copy(b, buffer[0:])
 			break
 		}
 	}
+	if err == nil {
+		c.capture(false, nil, b[:n])
+	}
 	return n, err
 }
 
 // ReadFromUDP reads a UDP packet from c, copying the payload into b.
 // It returns the number of bytes copied into b and the return address that
-// was on the packet.
+// was on the packet. Packets from the same remote address return the same
+// *UDPAddr, so reading does not allocate once the address has been seen.
 func (c *UDPConn) ReadFromUDP(b []byte) (n int, addr *UDPAddr, err error) {
+	var addrPort netip.AddrPort
+	if c.sim != nil {
+		n, addrPort, err = c.endpoint.read(b)
+		if err == nil {
+			addr = c.cachedAddr(addrPort)
+			c.capture(false, addr, b[:n])
+		}
+		return n, addr, err
+	}
 	var dropPercent = readDropPercent(c)
-	var naddr *net.UDPAddr
-	var buffer [2000]byte
 	for {
-		n, naddr, err = c.nconn.ReadFromUDP(buffer[0:])
+		n, addrPort, err = c.nconn.ReadFromUDPAddrPort(b)
 		if dropIt(dropPercent) {
 			if isLoggingEnabled() {
 				log.Printf("DROPPING read packet of length %d\n", n)
 			}
 		} else {
-			copy(b, buffer[0:])
-			if naddr != nil {
-				addr = &UDPAddr{naddr: naddr}
+			if addrPort.IsValid() {
+				// IPv4 peers of a dual-stack socket show up as IPv4-mapped IPv6 addresses
+				addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+				addr = c.cachedAddr(addrPort)
+			}
+			if err == nil {
+				c.capture(false, addr, b[:n])
 			}
 			break
 		}
@@ -72,6 +123,31 @@ func (c *UDPConn) ReadFromUDP(b []byte) (n int, addr *UDPAddr, err error) {
 	return n, addr, err
 }
 
+// Handled tells the simulated network that the work caused by a packet read from
+// c is done, e.g. the replies to it are sent. When the simulated network is enabled,
+// every packet read must be handled, or AdvanceClock waits for it forever (until c
+// is closed). It has no effect on the real network.
+func (c *UDPConn) Handled() {
+	if c.sim != nil {
+		c.sim.clock.work.add(&c.endpoint.pending, -1)
+	}
+}
+
+// cachedAddr returns the *UDPAddr for addrPort, creating it on first use.
+func (c *UDPConn) cachedAddr(addrPort netip.AddrPort) *UDPAddr {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+	if addr, ok := c.addrCache[addrPort]; ok {
+		return addr
+	}
+	if len(c.addrCache) >= maxCachedAddrs {
+		c.addrCache = make(map[netip.AddrPort]*UDPAddr)
+	}
+	addr := newUDPAddr(net.UDPAddrFromAddrPort(addrPort))
+	c.addrCache[addrPort] = addr
+	return addr
+}
+
 // Write implements the Conn Write method.
 func (c *UDPConn) Write(b []byte) (int, error) {
 	return c.write(b, nil)
@@ -86,6 +162,16 @@ func (c *UDPConn) WriteToUDP(b []byte, addr *UDPAddr) (int, error) {
 }
 
 func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
+	c.capture(true, addr, b)
+	if c.sim != nil {
+		// drops are decided by the simulated network
+		port := c.peerPort
+		if addr != nil {
+			port = addr.naddr.Port
+		}
+		c.sim.send(c.endpoint, port, b)
+		return len(b), nil
+	}
 	if dropIt(writeDropPercent(c)) {
 		if isLoggingEnabled() {
 			log.Printf("DROPPING written packet of length %d\n", len(b))
@@ -93,6 +179,24 @@ func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
 		// Drop it, but make it look like it was successful.
 		return len(b), nil
 	}
+	if c.faultDrop(addr) {
+		if isLoggingEnabled() {
+			log.Printf("DROPPING written packet of length %d by fault rule\n", len(b))
+		}
+		return len(b), nil
+	}
+	if imp := writeImpairment(c); imp != (Impairment{}) {
+		// Send a copy later, but make it look like it was sent now.
+		payload := append([]byte(nil), b...)
+		c.link(addr).schedule(imp, len(b), time.Now(), afterFunc, func() {
+			if addr == nil {
+				c.nconn.Write(payload)
+			} else {
+				c.nconn.WriteToUDP(payload, addr.toNet())
+			}
+		})
+		return len(b), nil
+	}
 	if addr == nil {
 		n, err := c.nconn.Write(b)
 		if err != nil {
@@ -103,6 +207,42 @@ func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
 	return c.nconn.WriteToUDP(b, addr.toNet())
 }
 
+// faultDrop returns true if a fault rule drops the packets written to addr.
+func (c *UDPConn) faultDrop(addr *UDPAddr) bool {
+	local, _ := c.nconn.LocalAddr().(*net.UDPAddr)
+	remote, _ := c.nconn.RemoteAddr().(*net.UDPAddr)
+	if addr != nil {
+		remote = addr.naddr
+	}
+	if local == nil || remote == nil {
+		return false
+	}
+	return faultDrop(local.AddrPort(), remote.AddrPort(), rand.Intn)
+}
+
+// link returns the impairment state of the packets written to addr.
+func (c *UDPConn) link(addr *UDPAddr) *impairedLink {
+	key := ""
+	if addr != nil {
+		key = addr.String()
+	}
+	c.linkMutex.Lock()
+	defer c.linkMutex.Unlock()
+	if c.links == nil {
+		c.links = make(map[string]*impairedLink)
+	}
+	link := c.links[key]
+	if link == nil {
+		link = newImpairedLink(time.Now().UnixNano())
+		c.links[key] = link
+	}
+	return link
+}
+
+func afterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
 // Close closes the connection.
 func (c *UDPConn) Close() error {
 	mapMutex.Lock()
@@ -111,6 +251,9 @@ func (c *UDPConn) Close() error {
 		delete(connectionMap, c)
 	}
 	mapMutex.Unlock()
+	if c.sim != nil {
+		return c.sim.close(c.endpoint)
+	}
 	return c.nconn.Close()
 }
 
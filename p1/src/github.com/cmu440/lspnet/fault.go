@@ -0,0 +1,183 @@
+package lspnet
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// FaultRule drops packets sent between specific addresses, on top of the global
+// drop percents. Addresses are host:port strings, where an empty host or port 0
+// matches any host or port, and an empty address matches any address.
+type FaultRule struct {
+	// Src is the address the packets are sent from.
+	Src string
+
+	// Dst is the address the packets are sent to.
+	Dst string
+
+	// Bidirectional also matches the packets sent from Dst to Src.
+	Bidirectional bool
+
+	// After is the number of matching packets let through before the rule starts
+	// dropping, e.g. to blackhole a client after its first N packets.
+	After int
+
+	// DropPercent is the percentage of matching packets dropped once the rule
+	// applies, 100 to drop all of them.
+	DropPercent int
+}
+
+// addrPattern matches addresses against the Src or Dst of a fault rule.
+type addrPattern struct {
+	addr netip.Addr // invalid to match any host
+	port uint16     // 0 to match any port
+}
+
+// AddrPattern matches addresses the same way as the Src and Dst of a FaultRule,
+// for programs which apply faults on top of lspnet, e.g. per client of a proxy.
+type AddrPattern struct {
+	p addrPattern
+}
+
+// ParseAddrPattern parses an address pattern written as the Src or Dst of a
+// FaultRule. It returns a non-nil error if the address can't be parsed.
+func ParseAddrPattern(s string) (AddrPattern, error) {
+	p, err := parseAddrPattern(s)
+	return AddrPattern{p}, err
+}
+
+// Match returns true if addr matches the pattern.
+func (p AddrPattern) Match(addr *UDPAddr) bool {
+	return p.p.match(addr.naddr.AddrPort())
+}
+
+type faultRule struct {
+	id       int
+	src, dst addrPattern
+	rule     FaultRule
+	matched  int // number of matching packets so far
+}
+
+var (
+	faultRules      []*faultRule
+	numFaultRules   int32 // len(faultRules), read without the lock on every packet
+	nextFaultRuleId int
+	faultMutex      sync.Mutex
+)
+
+// AddFaultRule installs a fault rule and returns its id, which can be passed to
+// RemoveFaultRule. It returns a non-nil error if an address can't be parsed.
+func AddFaultRule(rule FaultRule) (int, error) {
+	src, err := parseAddrPattern(rule.Src)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := parseAddrPattern(rule.Dst)
+	if err != nil {
+		return 0, err
+	}
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	nextFaultRuleId += 1
+	faultRules = append(faultRules, &faultRule{id: nextFaultRuleId, src: src, dst: dst, rule: rule})
+	atomic.StoreInt32(&numFaultRules, int32(len(faultRules)))
+	return nextFaultRuleId, nil
+}
+
+// Partition installs fault rules dropping all packets between any address in
+// group1 and any address in group2, in both directions, and returns their ids.
+func Partition(group1, group2 []string) ([]int, error) {
+	var ids []int
+	for _, addr1 := range group1 {
+		for _, addr2 := range group2 {
+			id, err := AddFaultRule(FaultRule{Src: addr1, Dst: addr2, Bidirectional: true, DropPercent: 100})
+			if err != nil {
+				for _, id := range ids {
+					RemoveFaultRule(id)
+				}
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// RemoveFaultRule removes the fault rule with the given id.
+func RemoveFaultRule(id int) {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	for i, rule := range faultRules {
+		if rule.id == id {
+			faultRules = append(faultRules[:i], faultRules[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreInt32(&numFaultRules, int32(len(faultRules)))
+}
+
+// ResetFaultRules removes all fault rules.
+func ResetFaultRules() {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	faultRules = nil
+	atomic.StoreInt32(&numFaultRules, 0)
+}
+
+func parseAddrPattern(s string) (addrPattern, error) {
+	if s == "" {
+		return addrPattern{}, nil
+	}
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return addrPattern{}, err
+	}
+	var p addrPattern
+	if portStr != "" {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return addrPattern{}, errors.New("invalid port in address " + s)
+		}
+		p.port = uint16(port)
+	}
+	if host != "" {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return addrPattern{}, err
+		}
+		p.addr, _ = netip.AddrFromSlice(ipAddr.IP)
+		p.addr = p.addr.Unmap()
+	}
+	return p, nil
+}
+
+// an unspecified address (e.g. of a socket listening on all addresses) matches any host
+func (p addrPattern) match(a netip.AddrPort) bool {
+	host := a.Addr().Unmap()
+	return (!p.addr.IsValid() || host.IsUnspecified() || p.addr == host) && (p.port == 0 || p.port == a.Port())
+}
+
+// return true if a fault rule drops the packet sent from local to remote. intn draws
+// the random numbers for rules which drop only part of the packets
+func faultDrop(local, remote netip.AddrPort, intn func(int) int) bool {
+	if atomic.LoadInt32(&numFaultRules) == 0 {
+		return false
+	}
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	for _, r := range faultRules {
+		if !(r.src.match(local) && r.dst.match(remote)) &&
+			!(r.rule.Bidirectional && r.src.match(remote) && r.dst.match(local)) {
+			continue
+		}
+		r.matched += 1
+		if r.matched > r.rule.After && (r.rule.DropPercent >= 100 || intn(100) < r.rule.DropPercent) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package lspnet
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Time after which a group of packets held back for reordering is released,
+// even though it has fewer packets than the reorder window.
+const reorderTimeout = 10 * time.Millisecond
+
+// Distribution is the shape of the random delay added on top of Impairment.Delay.
+type Distribution int
+
+const (
+	// Uniform delays are spread evenly from 0 to Jitter.
+	Uniform Distribution = iota
+	// Normal delays are the absolute value of a normal variate with standard
+	// deviation Jitter, mostly close to Delay with a few larger ones.
+	Normal
+	// Exponential delays have mean Jitter and a long tail, like the queueing
+	// delays of a congested link.
+	Exponential
+)
+
+// Impairment describes the network conditions met by the packets written in
+// one direction, on top of the drop percents. Packets are delayed, duplicated
+// and reordered independently on each pair of local and remote addresses.
+type Impairment struct {
+	// Delay is the one-way delay added to every packet.
+	Delay time.Duration
+
+	// Jitter is the scale of the random delay added on top of Delay, so packets
+	// sent close together may arrive out of order: the maximum, standard
+	// deviation or mean of the delay depending on JitterDistribution.
+	Jitter time.Duration
+
+	// JitterDistribution is the distribution of the random delay, Uniform by default.
+	JitterDistribution Distribution
+
+	// DuplicatePercent is the percentage of packets delivered twice, each
+	// copy with its own jitter.
+	DuplicatePercent int
+
+	// ReorderWindow, if greater than 1, holds packets back in groups of this
+	// many and releases each group in random order. A group which doesn't fill
+	// up within 10ms is released as it is.
+	ReorderWindow int
+
+	// Bandwidth is the maximum number of bytes per second, 0 for no limit.
+	// Packets over the limit are queued behind the earlier ones.
+	Bandwidth int
+}
+
+var (
+	clientWriteImpairment Impairment
+	serverWriteImpairment Impairment
+	impairmentMutex       sync.Mutex
+)
+
+// SetClientWriteImpairment sets the conditions met by packets written by clients.
+func SetClientWriteImpairment(imp Impairment) {
+	impairmentMutex.Lock()
+	defer impairmentMutex.Unlock()
+	clientWriteImpairment = imp
+}
+
+// SetServerWriteImpairment sets the conditions met by packets written by servers.
+func SetServerWriteImpairment(imp Impairment) {
+	impairmentMutex.Lock()
+	defer impairmentMutex.Unlock()
+	serverWriteImpairment = imp
+}
+
+// ResetImpairments removes all delays, duplication, reordering and bandwidth limits.
+func ResetImpairments() {
+	SetClientWriteImpairment(Impairment{})
+	SetServerWriteImpairment(Impairment{})
+}
+
+func writeImpairment(c *UDPConn) Impairment {
+	mapMutex.Lock()
+	isServer, ok := connectionMap[c]
+	mapMutex.Unlock()
+	impairmentMutex.Lock()
+	defer impairmentMutex.Unlock()
+	if ok && isServer {
+		return serverWriteImpairment
+	} else if ok && !isServer {
+		return clientWriteImpairment
+	}
+	return Impairment{}
+}
+
+// impairedLink holds the random number generator and the bandwidth and reordering
+// state of the packets sent from one address to another.
+type impairedLink struct {
+	mutex    sync.Mutex
+	rng      *rand.Rand
+	nextFree time.Time // when the packets sent so far have left, under a bandwidth limit
+	group    []func()  // packets held back for reordering
+	groupGen int       // number of groups released so far
+}
+
+func newImpairedLink(seed int64) *impairedLink {
+	return &impairedLink{rng: rand.New(rand.NewSource(seed))}
+}
+
+// return true if a packet is dropped by either of the given drop percents. both
+// are always drawn, so the schedule of the link doesn't depend on the drop percents
+func (l *impairedLink) drop(writePercent, readPercent int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	dropped := l.rng.Intn(100) < writePercent
+	return l.rng.Intn(100) < readPercent || dropped
+}
+
+// draw a random number in [0, n) from the link's generator
+func (l *impairedLink) intn(n int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rng.Intn(n)
+}
+
+// schedule the transmission of a packet of the given size according to imp. now is the
+// current time of the clock used, and after(d, f) calls f once d has passed on that clock
+func (l *impairedLink) schedule(imp Impairment, size int, now time.Time, after func(time.Duration, func()), transmit func()) {
+	l.mutex.Lock()
+	copies := 1
+	if imp.DuplicatePercent > 0 && l.rng.Intn(100) < imp.DuplicatePercent {
+		copies = 2
+	}
+	depart := now
+	if imp.Bandwidth > 0 {
+		if l.nextFree.After(depart) {
+			depart = l.nextFree
+		}
+		depart = depart.Add(time.Duration(size) * time.Second / time.Duration(imp.Bandwidth))
+		l.nextFree = depart
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = depart.Sub(now) + imp.Delay + l.jitter(imp)
+	}
+	l.mutex.Unlock()
+
+	for _, delay := range delays {
+		arrive := transmit
+		if imp.ReorderWindow > 1 {
+			arrive = func() { l.reorder(imp.ReorderWindow, after, transmit) }
+		}
+		if delay > 0 {
+			after(delay, arrive)
+		} else {
+			arrive()
+		}
+	}
+}
+
+// draw the random delay of a packet according to imp, the link's mutex must be held
+func (l *impairedLink) jitter(imp Impairment) time.Duration {
+	if imp.Jitter <= 0 {
+		return 0
+	}
+	switch imp.JitterDistribution {
+	case Normal:
+		return time.Duration(math.Abs(l.rng.NormFloat64()) * float64(imp.Jitter))
+	case Exponential:
+		return time.Duration(l.rng.ExpFloat64() * float64(imp.Jitter))
+	}
+	return time.Duration(l.rng.Int63n(int64(imp.Jitter) + 1))
+}
+
+// hold a packet back until window packets are held, then transmit them in random order
+func (l *impairedLink) reorder(window int, after func(time.Duration, func()), transmit func()) {
+	l.mutex.Lock()
+	l.group = append(l.group, transmit)
+	if len(l.group) == 1 {
+		gen := l.groupGen
+		after(reorderTimeout, func() { l.release(gen) })
+	}
+	full := len(l.group) >= window
+	l.mutex.Unlock()
+	if full {
+		l.release(-1)
+	}
+}
+
+// transmit all held back packets in random order. a timer releases the group it was
+// started for only, given by gen, while -1 releases whatever group is held
+func (l *impairedLink) release(gen int) {
+	l.mutex.Lock()
+	if (gen >= 0 && gen != l.groupGen) || len(l.group) == 0 {
+		l.mutex.Unlock()
+		return
+	}
+	group := l.group
+	l.group = nil
+	l.groupGen += 1
+	l.rng.Shuffle(len(group), func(i, j int) { group[i], group[j] = group[j], group[i] })
+	l.mutex.Unlock()
+	for _, transmit := range group {
+		transmit()
+	}
+}
@@ -7,6 +7,7 @@
 package lspnet
 
 import (
+	"errors"
 	"net"
 	"sync"
 )
@@ -26,7 +27,7 @@ func ResolveUDPAddr(ntwk, addr string) (*UDPAddr, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &UDPAddr{naddr: a}, nil
+	return newUDPAddr(a), nil
 }
 
 // ListenUDP behaves the same as the net.ListenUDP method (with some
@@ -35,15 +36,27 @@ func ResolveUDPAddr(ntwk, addr string) (*UDPAddr, error) {
 // Servers should use this method to begin listening for incoming
 // client connections.
 func ListenUDP(ntwk string, laddr *UDPAddr) (*UDPConn, error) {
-	var nladdr *net.UDPAddr
-	if laddr != nil {
-		nladdr = laddr.toNet()
+	var conn *UDPConn
+	if sim := currentSim(); sim != nil {
+		port := 0
+		if laddr != nil {
+			port = laddr.naddr.Port
+		}
+		var err error
+		if conn, err = newSimUDPConn(sim, port, 0); err != nil {
+			return nil, err
+		}
+	} else {
+		var nladdr *net.UDPAddr
+		if laddr != nil {
+			nladdr = laddr.toNet()
+		}
+		nconn, err := net.ListenUDP(ntwk, nladdr)
+		if err != nil {
+			return nil, err
+		}
+		conn = newUDPConn(nconn)
 	}
-	nconn, err := net.ListenUDP(ntwk, nladdr)
-	if err != nil {
-		return nil, err
-	}
-	conn := &UDPConn{nconn: nconn}
 	mapMutex.Lock()
 	// Add the server connection to the map.
 	connectionMap[conn] = true
@@ -56,18 +69,33 @@ func ListenUDP(ntwk string, laddr *UDPAddr) (*UDPConn, error) {
 //
 // Clients should use this method to connect to the server.
 func DialUDP(ntwk string, laddr, raddr *UDPAddr) (*UDPConn, error) {
-	var nladdr, nraddr *net.UDPAddr
-	if laddr != nil {
-		nladdr = laddr.toNet()
-	}
-	if raddr != nil {
-		nraddr = raddr.toNet()
-	}
-	nconn, err := net.DialUDP(ntwk, nladdr, nraddr)
-	if err != nil {
-		return nil, err
+	var conn *UDPConn
+	if sim := currentSim(); sim != nil {
+		if raddr == nil {
+			return nil, errors.New("raddr must not be nil")
+		}
+		port := 0
+		if laddr != nil {
+			port = laddr.naddr.Port
+		}
+		var err error
+		if conn, err = newSimUDPConn(sim, port, raddr.naddr.Port); err != nil {
+			return nil, err
+		}
+	} else {
+		var nladdr, nraddr *net.UDPAddr
+		if laddr != nil {
+			nladdr = laddr.toNet()
+		}
+		if raddr != nil {
+			nraddr = raddr.toNet()
+		}
+		nconn, err := net.DialUDP(ntwk, nladdr, nraddr)
+		if err != nil {
+			return nil, err
+		}
+		conn = newUDPConn(nconn)
 	}
-	conn := &UDPConn{nconn: nconn}
 	mapMutex.Lock()
 	// Add the client connection to the map.
 	connectionMap[conn] = false
@@ -0,0 +1,185 @@
+package lspnet
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Number of packets a simulated socket holds before further packets sent to it
+// are dropped, like a full socket receive buffer.
+const simInboxSize = 1024
+
+// First port handed out to simulated sockets which don't ask for a port.
+const simFirstEphemeralPort = 60000
+
+var (
+	// The simulated network, nil unless EnableSimulation has been called.
+	simNet   *simNetwork
+	simMutex sync.Mutex
+)
+
+// simNetwork is an in-process network of simulated sockets on a single host.
+// Sockets are told apart by port only, and every packet is delivered instantly
+// unless it is dropped. Drops are decided by one random number generator per
+// pair of sockets, seeded from the simulation seed and the order in which the
+// sockets were created, so a test which creates its sockets and sends its
+// packets in the same order sees exactly the same drops on every run.
+type simNetwork struct {
+	mutex     sync.Mutex
+	seed      int64
+	endpoints map[int]*simEndpoint // open sockets by port
+	numOpened int                  // number of sockets created so far
+	nextPort  int
+	links     map[[2]int]*impairedLink // drop decisions and impairments by (sender id, receiver id)
+	clock     *virtualClock
+}
+
+type simEndpoint struct {
+	conn    *UDPConn
+	id      int // creation order of the socket
+	addr    netip.AddrPort
+	inbox   chan simPacket
+	closed  chan struct{}
+	pending int // packets sent to the socket but not handled yet, guarded by clock.work.mutex
+}
+
+type simPacket struct {
+	payload []byte
+	from    netip.AddrPort
+}
+
+// EnableSimulation replaces the network used by ListenUDP and DialUDP with an
+// in-process simulated network, and the clock used by NewTicker with a virtual
+// clock which only moves when AdvanceClock is called. Packet drops set with
+// SetReadDropPercent and friends are decided by random number generators
+// derived from seed, so the same seed gives the same failure schedule. Sockets
+// created before the call keep using the real network.
+func EnableSimulation(seed int64) {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+	simNet = &simNetwork{
+		seed:      seed,
+		endpoints: make(map[int]*simEndpoint),
+		nextPort:  simFirstEphemeralPort,
+		links:     make(map[[2]int]*impairedLink),
+		clock:     &virtualClock{now: time.Unix(0, 0)},
+	}
+}
+
+// DisableSimulation switches ListenUDP, DialUDP and NewTicker back to the real
+// network and clock. Simulated sockets and tickers which are still open keep
+// working with each other until they are closed.
+func DisableSimulation() {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+	simNet = nil
+}
+
+func currentSim() *simNetwork {
+	simMutex.Lock()
+	defer simMutex.Unlock()
+	return simNet
+}
+
+// open a simulated socket for conn on the given port, or on a free port if port is 0.
+func (s *simNetwork) open(conn *UDPConn, port int) (*simEndpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if port == 0 {
+		for s.endpoints[s.nextPort] != nil {
+			s.nextPort += 1
+		}
+		port = s.nextPort
+		s.nextPort += 1
+	} else if s.endpoints[port] != nil {
+		return nil, errors.New("simulated address already in use")
+	}
+	e := &simEndpoint{
+		conn:   conn,
+		id:     s.numOpened,
+		addr:   netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), uint16(port)),
+		inbox:  make(chan simPacket, simInboxSize),
+		closed: make(chan struct{}),
+	}
+	s.numOpened += 1
+	s.endpoints[port] = e
+	return e, nil
+}
+
+// close a simulated socket, pending and further reads on it fail.
+func (s *simNetwork) close(e *simEndpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.endpoints[int(e.addr.Port())] != e {
+		return net.ErrClosed
+	}
+	delete(s.endpoints, int(e.addr.Port()))
+	close(e.closed)
+	// packets nobody is going to handle any more are not waited for
+	s.clock.work.clear(&e.pending)
+	return nil
+}
+
+// send a copy of b from a socket to the socket on the given port. the packet is lost
+// silently if no socket is open on the port, or if it is dropped by the sender's write
+// drop percent or the receiver's read drop percent. otherwise it is delayed, duplicated
+// and reordered according to the sender's write impairment, on the virtual clock.
+func (s *simNetwork) send(from *simEndpoint, port int, b []byte) {
+	s.mutex.Lock()
+	to := s.endpoints[port]
+	if to == nil {
+		s.mutex.Unlock()
+		return
+	}
+	link := s.links[[2]int{from.id, to.id}]
+	if link == nil {
+		h := fnv.New64a()
+		h.Write([]byte{byte(from.id), byte(from.id >> 8), byte(to.id), byte(to.id >> 8)})
+		link = newImpairedLink(s.seed ^ int64(h.Sum64()))
+		s.links[[2]int{from.id, to.id}] = link
+	}
+	s.mutex.Unlock()
+	if link.drop(writeDropPercent(from.conn), readDropPercent(to.conn)) {
+		return
+	}
+	if faultDrop(from.addr, to.addr, link.intn) {
+		return
+	}
+
+	packet := simPacket{append([]byte(nil), b...), from.addr}
+	transmit := func() {
+		// packets to a closed socket are lost, counting them would make AdvanceClock wait forever
+		s.mutex.Lock()
+		if s.endpoints[port] != to {
+			s.mutex.Unlock()
+			return
+		}
+		s.clock.work.add(&to.pending, 1)
+		s.mutex.Unlock()
+		select {
+		case to.inbox <- packet:
+		default:
+			s.clock.work.add(&to.pending, -1)
+		}
+	}
+	imp := writeImpairment(from.conn)
+	if imp == (Impairment{}) {
+		transmit()
+		return
+	}
+	link.schedule(imp, len(b), s.clock.Now(), s.clock.afterFunc, transmit)
+}
+
+// read a packet sent to a simulated socket, copying the payload into b.
+func (e *simEndpoint) read(b []byte) (int, netip.AddrPort, error) {
+	select {
+	case packet := <-e.inbox:
+		return copy(b, packet.payload), packet.from, nil
+	case <-e.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
@@ -0,0 +1,349 @@
+// UDP proxy which injects network faults between unmodified LSP clients and a server.
+//
+// Clients connect to the proxy instead of the server. Every client address gets
+// its own socket to the server, so the server sees one proxy address per client.
+// The datagrams forwarded in each direction are dropped, delayed, duplicated and
+// reordered by lspnet according to a schedule of phases read from a JSON config
+// file, for example:
+//
+//     {
+//         "listen": ":9000",
+//         "server": "localhost:9999",
+//         "repeat": "60s",
+//         "phases": [
+//             {"at": "0s"},
+//             {"at": "10s", "toServer": {"drop": 20}, "toClient": {"delay": "50ms", "jitter": "20ms", "shape": "normal"}},
+//             {"at": "30s", "partition": ["127.0.0.1:41234", "10.0.0.7"]},
+//             {"at": "45s", "partition": ["*"]}
+//         ]
+//     }
+//
+// Each phase starts the given time after the proxy starts and replaces the
+// conditions of the phase before it, so a phase with no conditions heals the
+// network. The clients matching partition can't reach the server and vice versa.
+// Its addresses are matched the same way as the addresses of lspnet fault rules,
+// where an empty host or port 0 matches any host or port; a host alone matches
+// all its ports, and "*" all clients. With repeat, the schedule starts over after
+// the given time.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+var (
+	configFile  = flag.String("config", "", "JSON config file with the addresses and the fault schedule")
+	idleTimeout = flag.Duration("idle", time.Minute, "time after which the socket of a silent client is closed")
+	showLogs    = flag.Bool("v", false, "show lspproxy logs")
+)
+
+func init() {
+	// Display time, file, and line number in log messages.
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+}
+
+// duration is a time.Duration written as a string such as "1.5s" in the config.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// conditions are the faults injected into the datagrams forwarded in one direction.
+type conditions struct {
+	Drop      int      `json:"drop"`      // percentage of datagrams dropped
+	Delay     duration `json:"delay"`     // delay added to every datagram
+	Jitter    duration `json:"jitter"`    // scale of the random delay added on top of delay
+	Shape     string   `json:"shape"`     // distribution of the random delay: uniform (default), normal or exponential
+	Duplicate int      `json:"duplicate"` // percentage of datagrams delivered twice
+	Reorder   int      `json:"reorder"`   // size of the groups of datagrams shuffled before delivery
+	Bandwidth int      `json:"bandwidth"` // maximum bytes per second, 0 for no limit
+}
+
+// distributions of the random delay by their name in the config
+var shapes = map[string]lspnet.Distribution{
+	"":            lspnet.Uniform,
+	"uniform":     lspnet.Uniform,
+	"normal":      lspnet.Normal,
+	"exponential": lspnet.Exponential,
+}
+
+func (c conditions) impairment() lspnet.Impairment {
+	return lspnet.Impairment{
+		Delay:              time.Duration(c.Delay),
+		Jitter:             time.Duration(c.Jitter),
+		JitterDistribution: shapes[c.Shape],
+		DuplicatePercent:   c.Duplicate,
+		ReorderWindow:      c.Reorder,
+		Bandwidth:          c.Bandwidth,
+	}
+}
+
+// phase is one step of the fault schedule.
+type phase struct {
+	At        duration   `json:"at"`
+	ToServer  conditions `json:"toServer"`
+	ToClient  conditions `json:"toClient"`
+	Partition []string   `json:"partition"` // client address patterns cut off from the server, "*" for all
+}
+
+type config struct {
+	Listen string   `json:"listen"`
+	Server string   `json:"server"`
+	Repeat duration `json:"repeat"`
+	Phases []phase  `json:"phases"`
+}
+
+func readConfig(path string) (*config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Listen == "" || cfg.Server == "" {
+		return nil, errors.New("listen and server addresses are required")
+	}
+	for i := 1; i < len(cfg.Phases); i++ {
+		if cfg.Phases[i].At < cfg.Phases[i-1].At {
+			return nil, fmt.Errorf("phase %d starts before phase %d", i, i-1)
+		}
+	}
+	for i, ph := range cfg.Phases {
+		if _, err := parsePartition(ph.Partition); err != nil {
+			return nil, fmt.Errorf("phase %d: %s", i, err)
+		}
+		for _, shape := range []string{ph.ToServer.Shape, ph.ToClient.Shape} {
+			if _, ok := shapes[shape]; !ok {
+				return nil, fmt.Errorf("phase %d: unknown shape %q", i, shape)
+			}
+		}
+	}
+	if cfg.Repeat > 0 && len(cfg.Phases) > 0 && cfg.Repeat <= cfg.Phases[len(cfg.Phases)-1].At {
+		return nil, errors.New("repeat must be later than the start of the last phase")
+	}
+	return &cfg, nil
+}
+
+// parse the client address patterns of a partition
+func parsePartition(addrs []string) ([]lspnet.AddrPattern, error) {
+	patterns := make([]lspnet.AddrPattern, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == "*" {
+			addr = ""
+		} else if _, _, err := lspnet.SplitHostPort(addr); err != nil {
+			// a host alone matches all its ports
+			addr = lspnet.JoinHostPort(addr, "0")
+		}
+		pattern, err := lspnet.ParseAddrPattern(addr)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// session forwards the datagrams of one client through its own socket to the server.
+type session struct {
+	clientAddr *lspnet.UDPAddr
+	conn       *lspnet.UDPConn // dialed to the server
+	lastActive time.Time
+}
+
+type proxy struct {
+	listenConn  *lspnet.UDPConn
+	serverAddr  *lspnet.UDPAddr
+	mutex       sync.Mutex
+	sessions    map[string]*session  // by client address
+	partitioned []lspnet.AddrPattern // client addresses cut off from the server
+}
+
+func main() {
+	flag.Parse()
+	if !*showLogs {
+		log.SetOutput(ioutil.Discard)
+	}
+	if *configFile == "" {
+		fmt.Println("Usage: lspproxy -config <file>")
+		os.Exit(2)
+	}
+	cfg, err := readConfig(*configFile)
+	if err != nil {
+		fmt.Printf("Failed to read config %s: %s\n", *configFile, err)
+		os.Exit(1)
+	}
+	p, err := newProxy(cfg)
+	if err != nil {
+		fmt.Printf("Failed to start proxy: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Proxying %s to %s...\n", cfg.Listen, cfg.Server)
+	go p.runSchedule(cfg)
+	go p.reapSessions()
+	p.forwardToServer()
+}
+
+func newProxy(cfg *config) (*proxy, error) {
+	laddr, err := lspnet.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	serverAddr, err := lspnet.ResolveUDPAddr("udp", cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	// the listening socket writes to clients and the dialed sockets write to the server,
+	// so the server drop percent and impairment of lspnet apply to the datagrams sent
+	// to clients, and the client ones to the datagrams sent to the server
+	listenConn, err := lspnet.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &proxy{
+		listenConn: listenConn,
+		serverAddr: serverAddr,
+		sessions:   make(map[string]*session),
+	}, nil
+}
+
+// apply the phases of the schedule as their start times come
+func (p *proxy) runSchedule(cfg *config) {
+	for start := time.Now(); ; start = start.Add(time.Duration(cfg.Repeat)) {
+		for _, ph := range cfg.Phases {
+			time.Sleep(time.Until(start.Add(time.Duration(ph.At))))
+			p.apply(ph)
+		}
+		if cfg.Repeat <= 0 {
+			return
+		}
+		time.Sleep(time.Until(start.Add(time.Duration(cfg.Repeat))))
+	}
+}
+
+func (p *proxy) apply(ph phase) {
+	fmt.Printf("Phase at %s: to server %+v, to client %+v, partition %v\n",
+		time.Duration(ph.At), ph.ToServer, ph.ToClient, ph.Partition)
+	lspnet.SetClientWriteDropPercent(ph.ToServer.Drop)
+	lspnet.SetClientWriteImpairment(ph.ToServer.impairment())
+	lspnet.SetServerWriteDropPercent(ph.ToClient.Drop)
+	lspnet.SetServerWriteImpairment(ph.ToClient.impairment())
+	// the patterns are checked by readConfig
+	partitioned, _ := parsePartition(ph.Partition)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.partitioned = partitioned
+}
+
+func (p *proxy) isPartitioned(clientAddr *lspnet.UDPAddr) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, pattern := range p.partitioned {
+		if pattern.Match(clientAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// read the datagrams of all clients and forward each through the socket of its client.
+// every datagram read is marked handled, for the simulated network of lspnet
+func (p *proxy) forwardToServer() {
+	buf := make([]byte, 2000)
+	for {
+		n, clientAddr, err := p.listenConn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("Failed to read from clients: %s\n", err)
+			return
+		}
+		p.forward(clientAddr, buf[:n])
+		p.listenConn.Handled()
+	}
+}
+
+// forward a datagram of a client to the server, unless the client is partitioned
+func (p *proxy) forward(clientAddr *lspnet.UDPAddr, b []byte) {
+	s, err := p.session(clientAddr)
+	if err != nil {
+		log.Printf("Failed to open socket for client %s: %s\n", clientAddr, err)
+		return
+	}
+	if p.isPartitioned(clientAddr) {
+		log.Printf("Partition drops datagram from client %s\n", clientAddr)
+		return
+	}
+	s.conn.Write(b)
+}
+
+// return the session of a client, opening it on the first datagram of the client
+func (p *proxy) session(clientAddr *lspnet.UDPAddr) (*session, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if s, ok := p.sessions[clientAddr.String()]; ok {
+		s.lastActive = time.Now()
+		return s, nil
+	}
+	conn, err := lspnet.DialUDP("udp", nil, p.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{clientAddr: clientAddr, conn: conn, lastActive: time.Now()}
+	p.sessions[clientAddr.String()] = s
+	fmt.Printf("Client %s connected\n", clientAddr)
+	go p.forwardToClient(s)
+	return s, nil
+}
+
+// forward the datagrams the server sends to a session back to its client
+func (p *proxy) forwardToClient(s *session) {
+	buf := make([]byte, 2000)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if p.isPartitioned(s.clientAddr) {
+			log.Printf("Partition drops datagram to client %s\n", s.clientAddr)
+		} else {
+			p.listenConn.WriteToUDP(buf[:n], s.clientAddr)
+		}
+		s.conn.Handled()
+	}
+}
+
+// close the sessions of clients which have been silent for the idle timeout
+func (p *proxy) reapSessions() {
+	for range time.Tick(*idleTimeout / 2) {
+		p.mutex.Lock()
+		for key, s := range p.sessions {
+			if time.Since(s.lastActive) > *idleTimeout {
+				fmt.Printf("Client %s idle, closing its socket\n", s.clientAddr)
+				s.conn.Close()
+				delete(p.sessions, key)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+// lspproxy tests.
+
+// These tests run an LSP server and client through the proxy on the simulated
+// network of lspnet, and step through the phases of a fault schedule. Epochs
+// only pass when the test advances the virtual clock, so whether a message got
+// through a phase is known exactly, without any real waiting.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// start a proxy in front of a server on the simulated network, with the config
+// given as JSON, and a client connected through it
+func startProxy(t *testing.T, configJSON string, params *lsp.Params) (*config, *proxy, lsp.Server, lsp.Client) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %s", err)
+	}
+	srv, err := lsp.NewServer(9999, params)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	p, err := newProxy(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %s", err)
+	}
+	go p.forwardToServer()
+	cli, err := lsp.NewClient(cfg.Listen, params)
+	if err != nil {
+		t.Fatalf("Failed to connect through the proxy: %s", err)
+	}
+	return cfg, p, srv, cli
+}
+
+func TestReadConfig(t *testing.T) {
+	for _, configJSON := range []string{
+		`{"server": "127.0.0.1:9999", "phases": []}`,
+		`{"listen": ":9000", "server": "127.0.0.1:9999", "phases": [{"at": "2s"}, {"at": "1s"}]}`,
+		`{"listen": ":9000", "server": "127.0.0.1:9999", "phases": [{"at": "0s", "partition": ["127.0.0.1:port"]}]}`,
+		`{"listen": ":9000", "server": "127.0.0.1:9999", "repeat": "1s", "phases": [{"at": "2s"}]}`,
+		`{"listen": ":9000", "server": "127.0.0.1:9999", "phases": [{"at": "0s", "toClient": {"shape": "pareto"}}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(path, []byte(configJSON), 0644); err != nil {
+			t.Fatalf("Failed to write config: %s", err)
+		}
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("readConfig accepted %s", configJSON)
+		}
+	}
+	if _, err := readConfig(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("readConfig returned %v for a missing file, expected it doesn't exist", err)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	lspnet.EnableSimulation(1)
+	defer lspnet.DisableSimulation()
+	params := &lsp.Params{EpochLimit: 10, EpochMillis: 1000, WindowSize: 1}
+	epoch := time.Duration(params.EpochMillis) * time.Millisecond
+	// the client is partitioned by its host alone, whatever its port
+	cfg, p, srv, cli := startProxy(t, `{
+		"listen": "127.0.0.1:9000",
+		"server": "127.0.0.1:9999",
+		"phases": [
+			{"at": "0s"},
+			{"at": "10s", "partition": ["127.0.0.1"]},
+			{"at": "20s"}
+		]
+	}`, params)
+	defer p.listenConn.Close()
+	defer srv.Close()
+	defer cli.Close()
+
+	for i, msg := range []string{"before", "during"} {
+		p.apply(cfg.Phases[i])
+		cli.Write([]byte(msg))
+		lspnet.AdvanceClock(3 * epoch)
+		if unacked := cli.Stats().UnAckedMsgs; (unacked == 0) != (i == 0) {
+			t.Fatalf("Phase %d: %d messages not acked after 3 epochs", i, unacked)
+		}
+	}
+	if _, payload, err := srv.Read(); err != nil || string(payload) != "before" {
+		t.Fatalf("Server read %q, %v, expected %q", payload, err, "before")
+	}
+
+	// the client's resends get through once the partition heals
+	p.apply(cfg.Phases[2])
+	lspnet.AdvanceClock(epoch)
+	if unacked := cli.Stats().UnAckedMsgs; unacked != 0 {
+		t.Fatalf("%d messages not acked after the partition healed", unacked)
+	}
+	if _, payload, err := srv.Read(); err != nil || string(payload) != "during" {
+		t.Fatalf("Server read %q, %v, expected %q", payload, err, "during")
+	}
+}
+
+func TestPartitionPatterns(t *testing.T) {
+	addr, err := lspnet.ResolveUDPAddr("udp", "127.0.0.1:41234")
+	if err != nil {
+		t.Fatalf("Failed to resolve address: %s", err)
+	}
+	for _, test := range []struct {
+		partition []string
+		matched   bool
+	}{
+		{nil, false},
+		{[]string{"*"}, true},
+		{[]string{"127.0.0.1:41234"}, true},
+		{[]string{"127.0.0.1:41235"}, false},
+		{[]string{"127.0.0.1"}, true},
+		{[]string{"127.0.0.1:0"}, true},
+		{[]string{":41234"}, true},
+		{[]string{"10.0.0.7", "127.0.0.1:41234"}, true},
+		{[]string{"10.0.0.7"}, false},
+	} {
+		p := &proxy{}
+		p.apply(phase{Partition: test.partition})
+		if matched := p.isPartitioned(addr); matched != test.matched {
+			t.Errorf("Partition %v matched %s: %v, expected %v", test.partition, addr, matched, test.matched)
+		}
+	}
+}
@@ -20,6 +20,7 @@ var (
 	epochMillis = flag.Int("ems", lsp.DefaultEpochMillis, "epoch duration (ms)")
 	windowSize  = flag.Int("wsize", lsp.DefaultWindowSize, "window size")
 	showLogs    = flag.Bool("v", false, "show srunner logs")
+	captureFile = flag.String("capture", "", "record the datagrams sent and received to this file")
 )
 
 func main() {
@@ -29,6 +30,13 @@ func main() {
 	}
 	lspnet.SetServerReadDropPercent(*readDrop)
 	lspnet.SetServerWriteDropPercent(*writeDrop)
+	if *captureFile != "" {
+		if err := lspnet.StartCaptureFile(*captureFile); err != nil {
+			fmt.Printf("Failed to start capture to %s: %s\n", *captureFile, err)
+			return
+		}
+		defer lspnet.StopCapture()
+	}
 	params := &lsp.Params{
 		EpochLimit:  *epochLimit,
 		EpochMillis: *epochMillis,